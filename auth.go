@@ -0,0 +1,111 @@
+package winrm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"net/http"
+)
+
+// autoAuth remembers the authentication scheme picked by AuthType Auto
+type autoAuth struct {
+	mu       sync.Mutex
+	authType string
+}
+
+// autoAuthType returns the AuthType to use in place of Auto. The first
+// call probes the endpoint with an anonymous request and picks the
+// strongest scheme it offers that the configured credentials allow.
+func (conf *SoapRequest) autoAuthType(ctx context.Context) (string, error) {
+	conf.setup()
+	conf.auto.mu.Lock()
+	defer conf.auto.mu.Unlock()
+	if conf.auto.authType != "" {
+		return conf.auto.authType, nil
+	}
+
+	// listeners do not announce certificate authentication, which is
+	// negotiated by TLS
+	if conf.CertAuth != nil && strings.HasPrefix(conf.Endpoint, "https:") {
+		conf.auto.authType = "CertAuth"
+		return conf.auto.authType, nil
+	}
+	offered, err := conf.probe(ctx)
+	if err != nil {
+		return "", err
+	}
+	authType, err := conf.chooseAuthType(offered)
+	if err != nil {
+		return "", err
+	}
+	conf.auto.authType = authType
+	return authType, nil
+}
+
+// probe posts an anonymous empty request and returns the authentication
+// schemes offered by the endpoint in its response
+func (conf *SoapRequest) probe(ctx context.Context) ([]string, error) {
+	protocol := strings.Split(conf.Endpoint, ":")
+	if protocol[0] != "http" && protocol[0] != "https" {
+		return nil, errors.New("Invalid protocol. Expected http or https")
+	}
+	conf.setup()
+	conn, err := conf.conns.get(conf)
+	if err != nil {
+		return nil, err
+	}
+	defer conf.conns.put(conn)
+	resp, err := conf.authPost(ctx, conn, nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	drainBody(resp)
+	if resp.StatusCode != 401 {
+		return nil, errors.New(fmt.Sprintf("Cannot negotiate authentication: remote host returned status code %d to an anonymous request", resp.StatusCode))
+	}
+	return offeredSchemes(resp), nil
+}
+
+// chooseAuthType picks the strongest of the offered schemes usable with
+// the configured credentials. CredSSP is never picked, as it hands the
+// credentials over to the host; it must be asked for explicitly. Kerberos
+// also fits a credential cache or keytab without Username; it is only
+// picked when Negotiate is offered, the scheme KerberosAuth sends.
+func (conf *SoapRequest) chooseAuthType(offered []string) (string, error) {
+	password := conf.Username != "" && conf.Passwd != ""
+	kerberos := conf.Kerberos != nil && (conf.Username != "" || conf.Kerberos.CCache != "" || conf.Kerberos.Keytab != "")
+	switch {
+	case kerberos && hasScheme(offered, "Negotiate"):
+		return "KerberosAuth", nil
+	case password && hasScheme(offered, "Negotiate"):
+		return "NTLMAuth", nil
+	case password && hasScheme(offered, "Basic"):
+		return "BasicAuth", nil
+	}
+	schemes := strings.Join(offered, ", ")
+	if schemes == "" {
+		schemes = "none"
+	}
+	return "", errors.New(fmt.Sprintf("No authentication scheme offered by the remote host fits the configured credentials; offered: %s", schemes))
+}
+
+// offeredSchemes lists the schemes of the WWW-Authenticate headers of
+// resp, in the order of the challenges
+func offeredSchemes(resp *http.Response) []string {
+	var schemes []string
+	for _, header := range resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		// a header may hold several challenges separated by commas,
+		// as do their parameters
+		for _, challenge := range strings.Split(header, ",") {
+			fields := strings.Fields(challenge)
+			if len(fields) == 0 || strings.Contains(fields[0], "=") || hasScheme(schemes, fields[0]) {
+				continue
+			}
+			schemes = append(schemes, fields[0])
+		}
+	}
+	return schemes
+}
@@ -0,0 +1,196 @@
+package winrm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	gc "launchpad.net/gocheck"
+)
+
+type AuthSuite struct{}
+
+var _ = gc.Suite(AuthSuite{})
+
+func (AuthSuite) TestOfferedSchemes(c *gc.C) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Add("WWW-Authenticate", "Negotiate")
+	resp.Header.Add("WWW-Authenticate", `Basic realm="WSMAN", CredSSP`)
+	resp.Header.Add("WWW-Authenticate", "negotiate")
+	c.Assert(offeredSchemes(resp), gc.DeepEquals, []string{"Negotiate", "Basic", "CredSSP"})
+
+	c.Assert(offeredSchemes(&http.Response{Header: http.Header{}}), gc.IsNil)
+}
+
+func (AuthSuite) TestChooseAuthType(c *gc.C) {
+	for _, t := range []struct {
+		conf     SoapRequest
+		offered  []string
+		authType string
+	}{{
+		conf:     SoapRequest{Username: "Administrator", Passwd: "Passw0rd"},
+		offered:  []string{"Basic", "Negotiate"},
+		authType: "NTLMAuth",
+	}, {
+		conf:     SoapRequest{Username: "Administrator", Passwd: "Passw0rd"},
+		offered:  []string{"Basic", "CredSSP"},
+		authType: "BasicAuth",
+	}, {
+		conf:     SoapRequest{Username: "alice@EXAMPLE.COM", Kerberos: &KerberosCredentials{Keytab: "alice.keytab"}},
+		offered:  []string{"Negotiate", "Basic"},
+		authType: "KerberosAuth",
+	}, {
+		conf:     SoapRequest{Username: "alice@EXAMPLE.COM", Passwd: "Passw0rd", Kerberos: &KerberosCredentials{}},
+		offered:  []string{"Kerberos", "Negotiate"},
+		authType: "KerberosAuth",
+	}, {
+		conf:     SoapRequest{Kerberos: &KerberosCredentials{CCache: "/tmp/krb5cc_1000"}},
+		offered:  []string{"Negotiate"},
+		authType: "KerberosAuth",
+	}} {
+		authType, err := t.conf.chooseAuthType(t.offered)
+		c.Assert(err, gc.IsNil)
+		c.Assert(authType, gc.Equals, t.authType)
+	}
+}
+
+func (AuthSuite) TestChooseAuthTypeNoneFits(c *gc.C) {
+	conf := SoapRequest{Username: "Administrator", Passwd: "Passw0rd"}
+	_, err := conf.chooseAuthType([]string{"CredSSP", "Kerberos"})
+	c.Assert(err, gc.ErrorMatches, "No authentication scheme offered by the remote host fits the configured credentials; offered: CredSSP, Kerberos")
+
+	_, err = conf.chooseAuthType(nil)
+	c.Assert(err, gc.ErrorMatches, "No authentication scheme offered by the remote host fits the configured credentials; offered: none")
+
+	conf = SoapRequest{Kerberos: &KerberosCredentials{}}
+	_, err = conf.chooseAuthType([]string{"Negotiate", "Basic"})
+	c.Assert(err, gc.ErrorMatches, ".*; offered: Negotiate, Basic")
+
+	// KerberosAuth sends Negotiate, which a host offering only Kerberos
+	// does not accept
+	conf = SoapRequest{Username: "alice@EXAMPLE.COM", Kerberos: &KerberosCredentials{}}
+	_, err = conf.chooseAuthType([]string{"Kerberos"})
+	c.Assert(err, gc.ErrorMatches, ".*; offered: Kerberos")
+}
+
+func (AuthSuite) TestSendMessageAutoNTLM(c *gc.C) {
+	server := newNTLMServer(c, "Passw0rd", false)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "Auto",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "Passw0rd",
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := req.SendMessage(&Envelope{})
+		c.Assert(err, gc.IsNil)
+		c.Assert(resp.StatusCode, gc.Equals, 200)
+		resp.Body.Close()
+	}
+	c.Assert(req.auto.authType, gc.Equals, "NTLMAuth")
+	c.Assert(server.handshakes, gc.Equals, 1)
+}
+
+func (AuthSuite) TestSendMessageAutoBasic(c *gc.C) {
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, passwd, ok := r.BasicAuth(); ok && user == "Administrator" && passwd == "Passw0rd" {
+			w.Write([]byte("trololol"))
+			return
+		}
+		probes++
+		w.Header().Add("WWW-Authenticate", `Basic realm="WSMAN"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "Auto",
+		Username: "Administrator",
+		Passwd:   "Passw0rd",
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := req.SendMessage(&Envelope{})
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, "trololol")
+	}
+	// the endpoint is only probed once
+	c.Assert(probes, gc.Equals, 1)
+}
+
+func (AuthSuite) TestSendMessageAutoConcurrent(c *gc.C) {
+	var mu sync.Mutex
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Write([]byte("trololol"))
+			return
+		}
+		mu.Lock()
+		probes++
+		mu.Unlock()
+		w.Header().Add("WWW-Authenticate", `Basic realm="WSMAN"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	// the state set up on first use is shared by concurrent requests
+	req := &SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "Auto",
+		Username: "Administrator",
+		Passwd:   "Passw0rd",
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := req.SendMessage(&Envelope{})
+			if err == nil {
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(probes, gc.Equals, 1)
+}
+
+func (AuthSuite) TestSendMessageAutoNoneFits(c *gc.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("WWW-Authenticate", "Negotiate")
+		w.Header().Add("WWW-Authenticate", "Kerberos")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	req := SoapRequest{Endpoint: server.URL, AuthType: "Auto"}
+	resp, err := req.SendMessage(&Envelope{})
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "No authentication scheme offered by the remote host fits the configured credentials; offered: Negotiate, Kerberos")
+}
+
+func (AuthSuite) TestSendMessageAutoNoChallenge(c *gc.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	req := SoapRequest{Endpoint: server.URL, AuthType: "Auto", Username: "Administrator", Passwd: "Passw0rd"}
+	resp, err := req.SendMessage(&Envelope{})
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Cannot negotiate authentication: remote host returned status code 403 to an anonymous request")
+}
@@ -0,0 +1,372 @@
+package winrm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"net/http"
+)
+
+// terminateTimeout bounds the best-effort terminate signal sent after the
+// caller's context has been cancelled
+const terminateTimeout = 10 * time.Second
+
+// Client runs remote shell operations against a single WinRM endpoint.
+// Every operation builds its own Envelope, so one Client can be shared
+// by several goroutines.
+type Client struct {
+	soap SoapRequest
+}
+
+// ClientOption configures a Client created by NewClient
+type ClientOption func(*SoapRequest)
+
+// WithBasicAuth authenticates using HTTP Basic authentication
+func WithBasicAuth(username, passwd string) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.AuthType = "BasicAuth"
+		soap.Username = username
+		soap.Passwd = passwd
+	}
+}
+
+// WithCertAuth authenticates using a client side certificate. The server
+// is verified against the CA of cert, if set.
+func WithCertAuth(cert *CertificateCredentials) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.AuthType = "CertAuth"
+		soap.CertAuth = cert
+	}
+}
+
+// WithNTLMAuth authenticates using NTLMv2. username may be given as
+// DOMAIN\user.
+func WithNTLMAuth(username, passwd string) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.AuthType = "NTLMAuth"
+		soap.Username = username
+		soap.Passwd = passwd
+	}
+}
+
+// WithKerberosAuth authenticates using Kerberos through the Negotiate
+// scheme. username may be given as user@REALM. passwd may be empty when
+// creds names a Keytab or a CCache; creds may be nil to log in with
+// passwd using the system krb5.conf.
+func WithKerberosAuth(username, passwd string, creds *KerberosCredentials) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.AuthType = "KerberosAuth"
+		soap.Username = username
+		soap.Passwd = passwd
+		soap.Kerberos = creds
+	}
+}
+
+// WithCredSSPAuth authenticates using CredSSP, delegating the credentials
+// to the server so that commands can authenticate to other hosts.
+// username may be given as DOMAIN\user.
+func WithCredSSPAuth(username, passwd string) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.AuthType = "CredSSPAuth"
+		soap.Username = username
+		soap.Passwd = passwd
+	}
+}
+
+// WithAutoAuth picks the authentication scheme among those offered by the
+// endpoint, preferring Kerberos, then NTLM, then Basic. Kerberos
+// credentials and a client certificate given by earlier WithKerberosAuth
+// or WithCertAuth options are used if the endpoint allows them.
+func WithAutoAuth(username, passwd string) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.AuthType = "Auto"
+		soap.Username = username
+		soap.Passwd = passwd
+	}
+}
+
+// WithInsecure disables verification of the server certificate
+func WithInsecure() ClientOption {
+	return func(soap *SoapRequest) {
+		soap.HttpInsecure = true
+	}
+}
+
+// WithServerVerification sets how the certificate of an https endpoint is
+// verified: against a CA bundle, for another name than the host of the
+// endpoint, or against pinned keys
+func WithServerVerification(verify *ServerVerification) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.Verification = verify
+	}
+}
+
+// WithKnownHosts trusts the certificate of the endpoint recorded in the
+// known hosts file at path, recording it on the first connection, in
+// place of verifying its chain. The chain is still verified when a CA is
+// set. A changed certificate fails the requests with a
+// *HostKeyMismatchError.
+func WithKnownHosts(path string) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.KnownHosts = NewKnownHosts(path)
+	}
+}
+
+// WithHttpClient makes the Client send the requests of BasicAuth and
+// CertAuth through httpClient, such as an *http.Client. Over https, the
+// client certificate, WithInsecure, WithServerVerification and
+// WithKnownHosts need the Transport of an *http.Client to be an
+// *http.Transport, a clone of which gets them in place of its own TLS
+// settings. The connection based schemes, such as NTLM, and the probe of
+// WithAutoAuth need connections of their own, which only keep the proxy
+// and dialer of such a Transport.
+func WithHttpClient(httpClient HttpDoer) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.HttpClient = httpClient
+	}
+}
+
+// WithRoundTripper makes the Client send the requests of BasicAuth and
+// CertAuth through rt, which sets up TLS itself unless the client
+// certificate, WithInsecure, WithServerVerification or WithKnownHosts are
+// used over https. These then need rt to be an *http.Transport, a clone
+// of which gets them in place of its own TLS settings. As with
+// WithHttpClient, the connection based schemes open connections of their
+// own.
+func WithRoundTripper(rt http.RoundTripper) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.HttpClient = &http.Client{Transport: rt}
+	}
+}
+
+// WithTransportWrapper wraps every transport built by the Client with
+// wrap, which may add logging, metrics or headers to the requests of any
+// authentication scheme
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.WrapTransport = wrap
+	}
+}
+
+// WithIdleConns keeps up to maxIdle idle connections to the endpoint, for
+// at most timeout each. Zero values keep the defaults of 8 connections
+// and 90 seconds.
+func WithIdleConns(maxIdle int, timeout time.Duration) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.MaxIdleConns = maxIdle
+		soap.IdleConnTimeout = timeout
+	}
+}
+
+// WithMaxEnvelopeSize asks the server to accept and send SOAP envelopes of
+// up to size bytes, in place of MaxEnvelopeSize. Larger envelopes carry
+// more input per Send and more output per Receive; size must not exceed
+// the MaxEnvelopeSizekb set on the server.
+func WithMaxEnvelopeSize(size int) ClientOption {
+	return func(soap *SoapRequest) {
+		soap.MaxEnvelopeSize = size
+	}
+}
+
+// NewClient returns a Client talking to endpoint, for example
+// https://host:5986/wsman
+func NewClient(endpoint string, options ...ClientOption) (*Client, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, errors.New("Invalid protocol. Expected http or https")
+	}
+	soap := SoapRequest{Endpoint: endpoint}
+	for _, option := range options {
+		option(&soap)
+	}
+	if soap.HttpClient == nil {
+		soap.HttpClient = &http.Client{}
+	}
+	soap.client = &sharedClient{}
+	soap.conns = &connPool{}
+	soap.kerberos = &kerberosLogin{}
+	soap.auto = &autoAuth{}
+	return &Client{soap: soap}, nil
+}
+
+// CreateShell creates a new remote shell and returns its ShellId. See
+// NewShell for a shell that keeps track of its own ShellId.
+func (c *Client) CreateShell(ctx context.Context, params ShellParams) (string, error) {
+	shell, err := c.createShell(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return shell.ShellId, nil
+}
+
+// createShell creates a new remote shell and returns its description
+func (c *Client) createShell(ctx context.Context, params ShellParams) (*ResponseShell, error) {
+	envelope := &Envelope{}
+	envelope.shellEnvelope(params)
+
+	respObj, err := c.post(ctx, envelope)
+	if err != nil {
+		return nil, err
+	}
+	if respObj.Body == nil || respObj.Body.Shell == nil || respObj.Body.Shell.ShellId == "" {
+		return nil, errors.New("Invalid server response")
+	}
+	return respObj.Body.Shell, nil
+}
+
+// Run starts params.Cmd inside the shell params.ShellID and returns the
+// CommandId of the new command
+func (c *Client) Run(ctx context.Context, params CmdParams) (string, error) {
+	envelope := &Envelope{}
+	if err := envelope.commandEnvelope(params); err != nil {
+		return "", err
+	}
+
+	respObj, err := c.post(ctx, envelope)
+	if err != nil {
+		return "", err
+	}
+	if respObj.Body == nil || respObj.Body.CommandResponse == nil {
+		return "", errors.New("Invalid server response")
+	}
+	return respObj.Body.CommandResponse.CommandId, nil
+}
+
+// Receive streams the output of commandID into stdout and stderr until
+// the command is done, then returns its exit code. Either writer may be
+// nil to discard that stream. If ctx is cancelled first, the command is
+// terminated on a best-effort basis.
+func (c *Client) Receive(ctx context.Context, shellID, commandID string, stdout, stderr io.Writer) (int, error) {
+	exitCode, err := receiveOutput(ctx, &c.soap, &Envelope{}, shellID, commandID, stdout, stderr)
+	if err != nil && ctx.Err() != nil {
+		c.terminate(shellID, commandID)
+	}
+	return exitCode, err
+}
+
+// Send delivers data to the stdin of commandID. end marks the last chunk
+// of input; data must fit in a single envelope.
+func (c *Client) Send(ctx context.Context, shellID, commandID string, data []byte, end bool) error {
+	size, err := c.soap.envelopeSize()
+	if err != nil {
+		return err
+	}
+	if len(data) > stdinChunkSize(size) {
+		return errors.New("Input exceeds MaxEnvelopeSize")
+	}
+	envelope := &Envelope{}
+	envelope.sendEnvelope(shellID, commandID, data, end)
+
+	_, err = c.post(ctx, envelope)
+	return err
+}
+
+// SendInput copies stdin to commandID in chunks that fit MaxEnvelopeSize,
+// marking the end of input once stdin returns io.EOF
+func (c *Client) SendInput(ctx context.Context, shellID, commandID string, stdin io.Reader) error {
+	size, err := c.soap.envelopeSize()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, stdinChunkSize(size))
+	for {
+		n, err := stdin.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		end := err == io.EOF
+		if n > 0 || end {
+			if err := c.Send(ctx, shellID, commandID, buf[:n], end); err != nil {
+				return err
+			}
+		}
+		if end {
+			return nil
+		}
+	}
+}
+
+// Execute runs params.Cmd to completion inside the shell params.ShellID.
+// stdin, when not nil, is fed to the command while its output is streamed
+// into stdout and stderr. Like os/exec, Execute does not wait for a Read
+// on stdin that is still blocked once the command has exited.
+func (c *Client) Execute(ctx context.Context, params CmdParams, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	commandID, err := c.Run(ctx, params)
+	if err != nil {
+		return 0, err
+	}
+	return c.communicate(ctx, params.ShellID, commandID, stdin, stdout, stderr)
+}
+
+// communicate feeds stdin, when not nil, to the running commandID while
+// streaming its output, and returns its exit code
+func (c *Client) communicate(ctx context.Context, shellID, commandID string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if stdin == nil {
+		return c.Receive(ctx, shellID, commandID, stdout, stderr)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := c.SendInput(ctx, shellID, commandID, stdin)
+		sendErr <- err
+		if err != nil {
+			// the command may be waiting for input that will never come
+			cancel()
+		}
+	}()
+
+	exitCode, err := c.Receive(ctx, shellID, commandID, stdout, stderr)
+	if err != nil {
+		select {
+		case serr := <-sendErr:
+			if serr != nil && serr != context.Canceled {
+				err = serr
+			}
+		default:
+		}
+	}
+	return exitCode, err
+}
+
+// Signal sends the signal code, such as SignalCtrlC, to commandID. The
+// short names ctrl_c, ctrl_break and terminate are accepted as well.
+// Signal may be called while another goroutine receives the output of
+// the command, to interrupt it.
+func (c *Client) Signal(ctx context.Context, shellID, commandID, code string) error {
+	envelope := &Envelope{}
+	envelope.signalEnvelope(shellID, commandID, code)
+
+	_, err := c.post(ctx, envelope)
+	return err
+}
+
+// DeleteShell deletes the remote shell shellID
+func (c *Client) DeleteShell(ctx context.Context, shellID string) error {
+	envelope := &Envelope{}
+	envelope.deleteEnvelope(shellID)
+
+	_, err := c.post(ctx, envelope)
+	return err
+}
+
+// post sends envelope and decodes the response, which must relate to it
+func (c *Client) post(ctx context.Context, envelope *Envelope) (ResponseEnvelope, error) {
+	resp, err := c.soap.sendMessage(ctx, envelope)
+	if err != nil {
+		return ResponseEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	return readResponse(resp.Body, envelope)
+}
+
+// terminate sends the terminate signal to commandID, independently of the
+// caller's (already cancelled) context
+func (c *Client) terminate(shellID, commandID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+	defer cancel()
+	c.Signal(ctx, shellID, commandID, SignalTerminate)
+}
@@ -0,0 +1,679 @@
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	gc "launchpad.net/gocheck"
+)
+
+type ClientSuite struct{}
+
+var _ = gc.Suite(ClientSuite{})
+
+const responseHead = `<s:Envelope xml:lang="en-US" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:x="http://schemas.xmlsoap.org/ws/2004/09/transfer" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell" xmlns:p="http://schemas.microsoft.com/wbem/wsman/1/wsman.xsd"><s:Header><a:Action>%s</a:Action><a:MessageID>uuid:EC452E31-2872-4921-8C0C-C76398695407</a:MessageID><a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To><a:RelatesTo>%s</a:RelatesTo></s:Header><s:Body>`
+
+const responseTail = `</s:Body></s:Envelope>`
+
+var fakeResponses = map[string]string{
+	"transfer/Create": `<rsp:Shell><rsp:ShellId>9731F5BD-E90B-403B-A8DB-010396CEBB4D</rsp:ShellId></rsp:Shell>`,
+	"shell/Command":   `<rsp:CommandResponse><rsp:CommandId>6D0A426F-4B4A-44F8-AF20-C35365258FEB</rsp:CommandId></rsp:CommandResponse>`,
+	"shell/Receive":   `<rsp:ReceiveResponse><rsp:Stream Name="stdout" CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB">c3VjaCBncmVhdA==</rsp:Stream><rsp:Stream Name="stdout" CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB" End="true"></rsp:Stream><rsp:Stream Name="stderr" CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB" End="true"></rsp:Stream><rsp:CommandState CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"><rsp:ExitCode>3</rsp:ExitCode></rsp:CommandState></rsp:ReceiveResponse>`,
+	"shell/Signal":    `<rsp:SignalResponse/>`,
+	"shell/Send":      `<rsp:SendResponse/>`,
+	"transfer/Delete": ``,
+}
+
+// fakeWinRM is a minimal WinRM listener answering every request with the
+// canned response matching its action
+type fakeWinRM struct {
+	*httptest.Server
+	mu      sync.Mutex
+	actions []string
+	bodies  []string
+	// replies queues responses for an action ahead of its canned one.
+	// Replies holding an s:Fault are sent with status 500.
+	replies map[string][]string
+	// hook, when set, is called before answering a request
+	hook func(action string)
+	// conns counts the connections accepted, resumed the requests made
+	// over a resumed TLS session
+	conns   int
+	resumed int
+}
+
+func newFakeWinRM() *fakeWinRM {
+	f := newUnstartedFakeWinRM()
+	f.Start()
+	return f
+}
+
+// newFakeWinRMTLS returns a fakeWinRM listening with https
+func newFakeWinRMTLS() *fakeWinRM {
+	f := newUnstartedFakeWinRM()
+	f.StartTLS()
+	return f
+}
+
+func newUnstartedFakeWinRM() *fakeWinRM {
+	f := &fakeWinRM{replies: make(map[string][]string)}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serveHTTP))
+	f.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+		}
+	}
+	return f
+}
+
+// connections returns how many connections were accepted and how many
+// requests came over a resumed TLS session
+func (f *fakeWinRM) connections() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns, f.resumed
+}
+
+func (f *fakeWinRM) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.TLS != nil && r.TLS.DidResume {
+		f.mu.Lock()
+		f.resumed++
+		f.mu.Unlock()
+	}
+	for suffix, resp := range fakeResponses {
+		action := "http://schemas.xmlsoap.org/ws/2004/09/" + suffix
+		if strings.HasPrefix(suffix, "shell/") {
+			action = "http://schemas.microsoft.com/wbem/wsman/1/windows/" + suffix
+		}
+		if !strings.Contains(string(body), ">"+action+"<") {
+			continue
+		}
+		f.mu.Lock()
+		f.actions = append(f.actions, suffix)
+		f.bodies = append(f.bodies, string(body))
+		hook := f.hook
+		if queued := f.replies[suffix]; len(queued) > 0 {
+			resp, f.replies[suffix] = queued[0], queued[1:]
+		}
+		f.mu.Unlock()
+		if hook != nil {
+			hook(suffix)
+		}
+		if strings.HasPrefix(resp, "<s:Fault") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, responseHead, action+"Response", requestMessageID(body))
+		fmt.Fprint(w, resp+responseTail)
+		return
+	}
+	http.Error(w, "unknown action", http.StatusBadRequest)
+}
+
+var messageID = regexp.MustCompile(`<a:MessageID>([^<]*)</a:MessageID>`)
+
+// requestMessageID returns the MessageID of a request, which responses
+// relate to
+func requestMessageID(body []byte) string {
+	if match := messageID.FindSubmatch(body); match != nil {
+		return string(match[1])
+	}
+	return ""
+}
+
+func (f *fakeWinRM) seen() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.actions...)
+}
+
+// received returns the bodies of every request made for action
+func (f *fakeWinRM) received(action string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var bodies []string
+	for i, seen := range f.actions {
+		if seen == action {
+			bodies = append(bodies, f.bodies[i])
+		}
+	}
+	return bodies
+}
+
+func (ClientSuite) TestNewClientInvalidProtocol(c *gc.C) {
+	client, err := NewClient("ftp://host/wsman")
+	c.Assert(client, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Invalid protocol. Expected http or https")
+}
+
+func (ClientSuite) TestClientLifecycle(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+
+	shellID, err := client.CreateShell(ctx, ShellParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(shellID, gc.Equals, "9731F5BD-E90B-403B-A8DB-010396CEBB4D")
+
+	commandID, err := client.Run(ctx, CmdParams{ShellID: shellID, Cmd: "dir"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(commandID, gc.Equals, "6D0A426F-4B4A-44F8-AF20-C35365258FEB")
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := client.Receive(ctx, shellID, commandID, &stdout, &stderr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stdout.String(), gc.Equals, "such great")
+	c.Assert(stderr.String(), gc.Equals, "")
+	c.Assert(exitCode, gc.Equals, 3)
+
+	c.Assert(client.Signal(ctx, shellID, commandID, SignalTerminate), gc.IsNil)
+	c.Assert(client.DeleteShell(ctx, shellID), gc.IsNil)
+	c.Assert(server.seen(), gc.DeepEquals, []string{"transfer/Create", "shell/Command", "shell/Receive", "shell/Signal", "transfer/Delete"})
+}
+
+func (ClientSuite) TestClientRunValidatesParams(c *gc.C) {
+	client, err := NewClient("http://127.0.0.1:1/wsman")
+	c.Assert(err, gc.IsNil)
+
+	_, err = client.Run(context.Background(), CmdParams{Cmd: "dir"})
+	c.Assert(err, gc.ErrorMatches, "Invalid ShellId")
+}
+
+func (ClientSuite) TestClientCancelledContext(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = client.CreateShell(ctx, ShellParams{})
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(server.seen(), gc.HasLen, 0)
+}
+
+func (ClientSuite) TestClientReceiveDeadlineTerminates(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	release := make(chan struct{})
+	defer close(release)
+	server.hook = func(action string) {
+		if action == "shell/Receive" {
+			<-release
+		}
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.Receive(ctx, "shell", "command", nil, nil)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < 5*time.Second, gc.Equals, true)
+	c.Assert(server.seen(), gc.DeepEquals, []string{"shell/Receive", "shell/Signal"})
+}
+
+func (ClientSuite) TestClientSignalDuringReceive(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	// the command runs until it is interrupted
+	receiving := make(chan struct{})
+	interrupted := make(chan struct{})
+	server.hook = func(action string) {
+		switch action {
+		case "shell/Receive":
+			close(receiving)
+			<-interrupted
+		case "shell/Signal":
+			close(interrupted)
+		}
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	var exitCode int
+	go func() {
+		var err error
+		exitCode, err = client.Receive(ctx, "shell", "1", nil, nil)
+		done <- err
+	}()
+	<-receiving
+	c.Assert(client.Signal(ctx, "shell", "1", "ctrl_c"), gc.IsNil)
+	c.Assert(<-done, gc.IsNil)
+	c.Assert(exitCode, gc.Equals, 3)
+
+	sent := server.received("shell/Signal")
+	c.Assert(sent, gc.HasLen, 1)
+	c.Assert(sent[0], gc.Matches, `(?s).*<rsp:Signal CommandId="1">\s*<rsp:Code>`+SignalCtrlC+`</rsp:Code>.*`)
+}
+
+func (ClientSuite) TestClientSignalCodes(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+
+	codes := []string{"ctrl_break", "terminate", SignalCtrlC}
+	for _, code := range codes {
+		c.Assert(client.Signal(ctx, "shell", "1", code), gc.IsNil)
+	}
+	sent := server.received("shell/Signal")
+	c.Assert(sent, gc.HasLen, 3)
+	for i, code := range []string{SignalCtrlBreak, SignalTerminate, SignalCtrlC} {
+		c.Assert(strings.Contains(sent[i], "<rsp:Code>"+code+"</rsp:Code>"), gc.Equals, true)
+	}
+}
+
+const timedOutFault = `<s:Fault><s:Code><s:Value>s:Receiver</s:Value><s:Subcode><s:Value>w:TimedOut</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en-US">The WS-Management service cannot complete the operation within the time specified in OperationTimeout.</s:Text></s:Reason><s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150858793" Machine="windows-host"><f:Message>The WS-Management service cannot complete the operation within the time specified in OperationTimeout.  </f:Message></f:WSManFault></s:Detail></s:Fault>`
+
+func (ClientSuite) TestClientReceivePollsUntilDone(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{
+		`<rsp:ReceiveResponse><rsp:Stream Name="stdout" CommandId="1">c3VjaCBncmVhdA0K</rsp:Stream><rsp:CommandState CommandId="1" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Running"></rsp:CommandState></rsp:ReceiveResponse>`,
+		timedOutFault,
+		`<rsp:ReceiveResponse><rsp:Stream Name="stderr" CommandId="1">bmVlZHMgbW9yZSBsaW5lcw==</rsp:Stream><rsp:CommandState CommandId="1" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Running"></rsp:CommandState></rsp:ReceiveResponse>`,
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := client.Receive(context.Background(), "shell", "1", &stdout, &stderr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stdout.String(), gc.Equals, "such great\r\nsuch great")
+	c.Assert(stderr.String(), gc.Equals, "needs more lines")
+	c.Assert(exitCode, gc.Equals, 3)
+	c.Assert(server.seen(), gc.DeepEquals, []string{"shell/Receive", "shell/Receive", "shell/Receive", "shell/Receive"})
+}
+
+func (ClientSuite) TestClientReceiveFault(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{
+		`<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>w:InvalidSelectors</s:Value></s:Subcode></s:Code></s:Fault>`,
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+
+	_, err = client.Receive(context.Background(), "shell", "1", nil, nil)
+	c.Assert(err, gc.ErrorMatches, "WS-Management fault w:InvalidSelectors")
+	fault, ok := err.(*WSManFault)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(fault.Code, gc.Equals, "s:Sender")
+}
+
+func (ClientSuite) TestClientExecuteWithStdin(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	// the command only finishes once the end of its input was sent
+	gotInput := make(chan struct{})
+	sends := 0
+	server.hook = func(action string) {
+		switch action {
+		case "shell/Send":
+			if sends++; sends == 2 {
+				close(gotInput)
+			}
+		case "shell/Receive":
+			<-gotInput
+		}
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+
+	var stdout bytes.Buffer
+	params := CmdParams{ShellID: "shell", Cmd: "powershell", Args: "-Command -"}
+	exitCode, err := client.Execute(context.Background(), params, strings.NewReader("hello"), &stdout, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(exitCode, gc.Equals, 3)
+	c.Assert(stdout.String(), gc.Equals, "such great")
+
+	sent := server.received("shell/Send")
+	c.Assert(sent, gc.HasLen, 2)
+	c.Assert(sent[0], gc.Matches, `(?s).*<rsp:Stream Name="stdin" CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB">aGVsbG8=</rsp:Stream>.*`)
+	c.Assert(sent[1], gc.Matches, `(?s).*<rsp:Stream Name="stdin" CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB" End="true"></rsp:Stream>.*`)
+}
+
+func (ClientSuite) TestClientSendInputChunks(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+
+	input := bytes.Repeat([]byte("x"), stdinChunkSize(MaxEnvelopeSize)+10)
+	err = client.SendInput(context.Background(), "shell", "1", bytes.NewReader(input))
+	c.Assert(err, gc.IsNil)
+
+	sent := server.received("shell/Send")
+	c.Assert(sent, gc.HasLen, 3)
+	c.Assert(strings.Contains(sent[0], `End="true"`), gc.Equals, false)
+	c.Assert(strings.Contains(sent[1], `End="true"`), gc.Equals, false)
+	c.Assert(sent[2], gc.Matches, `(?s).*<rsp:Stream Name="stdin" CommandId="1" End="true"></rsp:Stream>.*`)
+	for _, body := range sent {
+		c.Assert(len(body) <= MaxEnvelopeSize, gc.Equals, true)
+	}
+}
+
+func (ClientSuite) TestClientSendTooLarge(c *gc.C) {
+	client, err := NewClient("http://127.0.0.1:1/wsman")
+	c.Assert(err, gc.IsNil)
+
+	err = client.Send(context.Background(), "shell", "1", make([]byte, stdinChunkSize(MaxEnvelopeSize)+1), true)
+	c.Assert(err, gc.ErrorMatches, "Input exceeds MaxEnvelopeSize")
+}
+
+func (ClientSuite) TestClientMaxEnvelopeSize(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithMaxEnvelopeSize(512000))
+	c.Assert(err, gc.IsNil)
+	input := bytes.Repeat([]byte("x"), stdinChunkSize(MaxEnvelopeSize)+10)
+	err = client.SendInput(context.Background(), "shell", "1", bytes.NewReader(input))
+	c.Assert(err, gc.IsNil)
+
+	// the input fits in a single envelope of the size asked of the server,
+	// followed by the end of input
+	sent := server.received("shell/Send")
+	c.Assert(sent, gc.HasLen, 2)
+	c.Assert(sent[1], gc.Matches, `(?s).*<rsp:Stream Name="stdin" CommandId="1" End="true"></rsp:Stream>.*`)
+	c.Assert(sent[0], gc.Matches, `(?s).*<w:MaxEnvelopeSize mustUnderstand="true">512000</w:MaxEnvelopeSize>.*`)
+	c.Assert(len(sent[0]) <= 512000, gc.Equals, true)
+
+	client, err = NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithMaxEnvelopeSize(4096))
+	c.Assert(err, gc.IsNil)
+	err = client.SendInput(context.Background(), "shell", "1", bytes.NewReader(input))
+	c.Assert(err, gc.ErrorMatches, "MaxEnvelopeSize must be at least 8192 bytes")
+	c.Assert(executeCommand(client), gc.ErrorMatches, "MaxEnvelopeSize must be at least 8192 bytes")
+}
+
+// executeCommand runs a command through client in the canned shell
+func executeCommand(client *Client) error {
+	var stdout, stderr bytes.Buffer
+	params := CmdParams{ShellID: "9731F5BD-E90B-403B-A8DB-010396CEBB4D", Cmd: "whoami"}
+	_, err := client.Execute(context.Background(), params, nil, &stdout, &stderr)
+	return err
+}
+
+func (ClientSuite) TestClientReusesConnections(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithInsecure())
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(executeCommand(client), gc.IsNil)
+	}
+	conns, _ := server.connections()
+	c.Assert(conns, gc.Equals, 1)
+	c.Assert(len(server.seen()) > 3, gc.Equals, true)
+}
+
+func (ClientSuite) TestEnvelopeReusesConnections(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	// the methods of Envelope take SoapRequest by value, and its copies
+	// share the connections all the same
+	soap := SoapRequest{
+		Endpoint:     server.URL,
+		AuthType:     "BasicAuth",
+		Username:     "leeroy",
+		Passwd:       "jenkins",
+		HttpInsecure: true,
+	}
+	for i := 0; i < 2; i++ {
+		_, _, _, err := (&Envelope{}).RunCommand(ShellParams{}, CmdParams{Cmd: "whoami"}, soap)
+		c.Assert(err, gc.IsNil)
+	}
+	conns, _ := server.connections()
+	c.Assert(conns, gc.Equals, 1)
+	c.Assert(len(server.seen()) > 5, gc.Equals, true)
+}
+
+func (ClientSuite) TestClientResumesTLSSessions(c *gc.C) {
+	server := newUnstartedFakeWinRM()
+	server.Config.SetKeepAlivesEnabled(false)
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithInsecure())
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+	conns, resumed := server.connections()
+	c.Assert(conns > 1, gc.Equals, true)
+	// only the first connection makes a full handshake
+	c.Assert(resumed, gc.Equals, conns-1)
+}
+
+func (ClientSuite) TestClientIdleConns(c *gc.C) {
+	client, err := NewClient("https://host:5986/wsman", WithBasicAuth("leeroy", "jenkins"), WithIdleConns(2, time.Second))
+	c.Assert(err, gc.IsNil)
+	httpClient, err := client.soap.httpClient(false)
+	c.Assert(err, gc.IsNil)
+	again, err := client.soap.httpClient(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(again, gc.Equals, httpClient)
+
+	tr := httpClient.(*http.Client).Transport.(*http.Transport)
+	c.Assert(tr.MaxIdleConnsPerHost, gc.Equals, 2)
+	c.Assert(tr.IdleConnTimeout, gc.Equals, time.Second)
+	c.Assert(tr.TLSClientConfig.ClientSessionCache, gc.NotNil)
+
+	client, err = NewClient("https://host:5986/wsman", WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	httpClient, err = client.soap.httpClient(false)
+	c.Assert(err, gc.IsNil)
+	tr = httpClient.(*http.Client).Transport.(*http.Transport)
+	c.Assert(tr.MaxIdleConnsPerHost, gc.Equals, defaultMaxIdleConns)
+	c.Assert(tr.IdleConnTimeout, gc.Equals, defaultIdleConnTimeout)
+}
+
+func (ClientSuite) TestClientPerCertAuth(c *gc.C) {
+	dir := c.MkDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.Assert(ioutil.WriteFile(cert, []byte(cert_pem), 0644), gc.IsNil)
+	c.Assert(ioutil.WriteFile(key, []byte(cert_key), 0600), gc.IsNil)
+	client, err := NewClient("https://host:5986/wsman", WithCertAuth(&CertificateCredentials{Cert: cert, Key: key}))
+	c.Assert(err, gc.IsNil)
+
+	// the certificate is only presented by the client asked for it,
+	// whichever is built first
+	plain, err := client.soap.httpClient(false)
+	c.Assert(err, gc.IsNil)
+	withCert, err := client.soap.httpClient(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(withCert, gc.Not(gc.Equals), plain)
+	c.Assert(plain.(*http.Client).Transport.(*http.Transport).TLSClientConfig.Certificates, gc.HasLen, 0)
+	c.Assert(withCert.(*http.Client).Transport.(*http.Transport).TLSClientConfig.Certificates, gc.HasLen, 1)
+
+	again, err := client.soap.httpClient(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(again, gc.Equals, withCert)
+}
+
+// BenchmarkCommand runs commands through a single Client, which reuses
+// its connection
+func (ClientSuite) BenchmarkCommand(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithInsecure())
+	c.Assert(err, gc.IsNil)
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		c.Assert(executeCommand(client), gc.IsNil)
+	}
+}
+
+// BenchmarkCommandNewConnections runs each command through a Client of its
+// own, making a TCP and TLS handshake as every request once did
+func (ClientSuite) BenchmarkCommandNewConnections(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithInsecure())
+		c.Assert(err, gc.IsNil)
+		c.Assert(executeCommand(client), gc.IsNil)
+	}
+}
+
+// roundTripperFunc turns a function into an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// countingDoer sends requests through http.DefaultClient, counting them
+type countingDoer struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (d *countingDoer) Do(req *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	d.n++
+	d.mu.Unlock()
+	return http.DefaultClient.Do(req)
+}
+
+func (ClientSuite) TestClientHttpDoer(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	doer := &countingDoer{}
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithHttpClient(doer))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+	c.Assert(doer.n, gc.Equals, len(server.seen()))
+}
+
+func (ClientSuite) TestClientRoundTripper(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithRoundTripper(server.Client().Transport))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+}
+
+func (ClientSuite) TestClientRoundTripperVerification(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	// the CA is applied to a clone of the transport, which is left as is
+	tr := &http.Transport{}
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithRoundTripper(tr),
+		WithServerVerification(&ServerVerification{CA: writeCA(c, server)}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+	c.Assert(tr.TLSClientConfig == nil || tr.TLSClientConfig.RootCAs == nil, gc.Equals, true)
+
+	client, err = NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithRoundTripper(tr),
+		WithServerVerification(&ServerVerification{PinnedKeys: []string{"bm9wZQ=="}}), WithInsecure())
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.ErrorMatches, ".*Server certificate does not match any pinned key")
+	// only the requests of the first client reached the server
+	c.Assert(server.seen(), gc.HasLen, 2)
+}
+
+func (ClientSuite) TestClientRoundTripperKeepsTLSConfig(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	// the server is verified against the RootCAs of the transport, on top
+	// of which the pinned key is checked
+	tr := server.Client().Transport.(*http.Transport)
+	pin := PublicKeyPin(server.Certificate())
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithRoundTripper(tr),
+		WithServerVerification(&ServerVerification{PinnedKeys: []string{pin}}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+	c.Assert(tr.TLSClientConfig.VerifyConnection, gc.IsNil)
+
+	client, err = NewClient(server.URL, WithNTLMAuth("leeroy", "jenkins"), WithRoundTripper(tr),
+		WithServerVerification(&ServerVerification{PinnedKeys: []string{"bm9wZQ=="}}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.ErrorMatches, ".*Server certificate does not match any pinned key")
+}
+
+func (ClientSuite) TestClientHttpDoerVerification(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithHttpClient(&countingDoer{}), WithInsecure())
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.ErrorMatches, "HttpClient must be an \\*http.Client to apply CertAuth, HttpInsecure, Verification or KnownHosts")
+
+	rt := roundTripperFunc(server.Client().Transport.RoundTrip)
+	client, err = NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithRoundTripper(rt), WithKnownHosts(filepath.Join(c.MkDir(), "known_hosts")))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.ErrorMatches, "The Transport of HttpClient must be an \\*http.Transport to apply CertAuth, HttpInsecure, Verification or KnownHosts")
+	c.Assert(server.seen(), gc.HasLen, 0)
+}
+
+func (ClientSuite) TestClientTransportWrapper(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	var mu sync.Mutex
+	var agents []string
+	wrap := func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			agents = append(agents, req.Header.Get("User-Agent"))
+			mu.Unlock()
+			return rt.RoundTrip(req)
+		})
+	}
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithInsecure(), WithTransportWrapper(wrap))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+	c.Assert(agents, gc.HasLen, len(server.seen()))
+	c.Assert(agents[0], gc.Equals, "Go WinRM client")
+}
+
+func (ClientSuite) TestClientCancelRequest(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	release := make(chan struct{})
+	defer close(release)
+	server.hook = func(action string) { <-release }
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.CreateShell(ctx, ShellParams{})
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+}
@@ -0,0 +1,162 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Errors of client certificates that cannot be loaded
+var (
+	// ErrEncryptedKey is returned for a PEM private key protected by a
+	// passphrase, which must be decrypted first
+	ErrEncryptedKey = errors.New("Client certificate key is encrypted: decrypt it first, for example with openssl pkey")
+	// ErrKeyMismatch is returned when the private key is not the one of
+	// the certificate
+	ErrKeyMismatch = errors.New("Client certificate key does not match the certificate")
+)
+
+// CertificateFromPEM returns the client certificate made of certPEM, the
+// certificate followed by any intermediate authority, and keyPEM, its
+// unencrypted private key
+func CertificateFromPEM(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	for rest := keyPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+			return tls.Certificate{}, ErrEncryptedKey
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil && keyMismatch(certPEM, keyPEM) {
+		return tls.Certificate{}, ErrKeyMismatch
+	}
+	return cert, err
+}
+
+// keyMismatch reports whether the first certificate of certPEM and the
+// key of keyPEM could be read, and are not a pair
+func keyMismatch(certPEM, keyPEM []byte) bool {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return false
+	}
+	key, err := parsePrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return false
+	}
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && !public.Equal(leaf.PublicKey)
+}
+
+// parsePrivateKey parses a PKCS#1, PKCS#8 or SEC 1 private key
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key type")
+	}
+	return signer, nil
+}
+
+// CertificateFromPKCS12 returns the client certificate of a PKCS#12
+// bundle, such as a .pfx file exported by Windows, protected by password.
+// Other certificates of the bundle are sent as intermediate authorities.
+func CertificateFromPKCS12(pfx []byte, password string) (tls.Certificate, error) {
+	blocks, err := pkcs12.ToPEM(pfx, password)
+	if err == pkcs12.ErrIncorrectPassword {
+		return tls.Certificate{}, errors.New("Incorrect password for the PKCS#12 bundle")
+	}
+	if _, ok := err.(pkcs12.NotImplementedError); ok {
+		return tls.Certificate{}, errors.New(fmt.Sprintf("Unsupported PKCS#12 bundle (%s): export it with AES256-SHA256 or TripleDES-SHA1 encryption", err))
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var key crypto.Signer
+	var certs []*pem.Block
+	for _, block := range blocks {
+		switch block.Type {
+		case "PRIVATE KEY":
+			if key != nil {
+				return tls.Certificate{}, errors.New("PKCS#12 bundle holds more than one private key")
+			}
+			if key, err = parsePrivateKey(block.Bytes); err != nil {
+				return tls.Certificate{}, err
+			}
+		case "CERTIFICATE":
+			certs = append(certs, block)
+		}
+	}
+	if key == nil {
+		return tls.Certificate{}, errors.New("PKCS#12 bundle holds no private key")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// the certificate of the key goes first, whatever its place in the
+	// bundle
+	var certPEM bytes.Buffer
+	for _, leaf := range []bool{true, false} {
+		for _, block := range certs {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+			if ok && public.Equal(cert.PublicKey) == leaf {
+				pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes})
+			}
+		}
+	}
+	return CertificateFromPEM(certPEM.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// certificate returns the client certificate of creds, from the first of
+// Certificate, PKCS12, CertPEM and KeyPEM, or the Cert and Key files set
+func (creds *CertificateCredentials) certificate() (tls.Certificate, error) {
+	switch {
+	case creds.Certificate != nil:
+		return *creds.Certificate, nil
+	case creds.PKCS12 != nil:
+		return CertificateFromPKCS12(creds.PKCS12, creds.PKCS12Password)
+	case creds.CertPEM != nil || creds.KeyPEM != nil:
+		return CertificateFromPEM(creds.CertPEM, creds.KeyPEM)
+	}
+	certPEM, err := ioutil.ReadFile(creds.Cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(creds.Key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return CertificateFromPEM(certPEM, keyPEM)
+}
@@ -0,0 +1,113 @@
+package winrm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+
+	gc "launchpad.net/gocheck"
+)
+
+type ClientCertSuite struct{}
+
+var _ = gc.Suite(ClientCertSuite{})
+
+func readClientCert(c *gc.C, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/clientcert/" + name)
+	c.Assert(err, gc.IsNil)
+	return data
+}
+
+func (ClientCertSuite) TestCertificateFromPEM(c *gc.C) {
+	cert, err := CertificateFromPEM(readClientCert(c, "client.pem"), readClientCert(c, "client.key"))
+	c.Assert(err, gc.IsNil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(leaf.Subject.CommonName, gc.Equals, "administrator")
+
+	_, err = CertificateFromPEM(readClientCert(c, "client.pem"), readClientCert(c, "client-encrypted.key"))
+	c.Assert(err, gc.Equals, ErrEncryptedKey)
+	// the key of the CA is not the one of the client certificate
+	ca := readClientCert(c, "ca.pem")
+	_, err = CertificateFromPEM(ca, readClientCert(c, "client.key"))
+	c.Assert(err, gc.Equals, ErrKeyMismatch)
+	_, err = CertificateFromPEM(readClientCert(c, "client.pem"), nil)
+	c.Assert(err, gc.NotNil)
+}
+
+func (ClientCertSuite) TestCertificateFromPKCS12(c *gc.C) {
+	cert, err := CertificateFromPKCS12(readClientCert(c, "client.pfx"), "Passw0rd")
+	c.Assert(err, gc.IsNil)
+	// the certificate of the key comes first, followed by the CA
+	c.Assert(cert.Certificate, gc.HasLen, 2)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(leaf.Subject.CommonName, gc.Equals, "administrator")
+	ca, err := x509.ParseCertificate(cert.Certificate[1])
+	c.Assert(err, gc.IsNil)
+	c.Assert(ca.Subject.CommonName, gc.Equals, "winrm test CA")
+
+	_, err = CertificateFromPKCS12(readClientCert(c, "client.pfx"), "wrong")
+	c.Assert(err, gc.ErrorMatches, "Incorrect password for the PKCS#12 bundle")
+	// bundles exported with AES256-SHA256 use PBES2
+	aes, err := CertificateFromPKCS12(readClientCert(c, "client-aes.pfx"), "Passw0rd")
+	c.Assert(err, gc.IsNil)
+	c.Assert(aes.Certificate[0], gc.DeepEquals, cert.Certificate[0])
+	_, err = CertificateFromPKCS12(readClientCert(c, "client-aes.pfx"), "wrong")
+	c.Assert(err, gc.ErrorMatches, "Incorrect password for the PKCS#12 bundle")
+}
+
+func (ClientCertSuite) TestCertificateCredentials(c *gc.C) {
+	pemCert, err := CertificateFromPEM(readClientCert(c, "client.pem"), readClientCert(c, "client.key"))
+	c.Assert(err, gc.IsNil)
+	for _, creds := range []*CertificateCredentials{
+		{Cert: "testdata/clientcert/client.pem", Key: "testdata/clientcert/client.key"},
+		{CertPEM: readClientCert(c, "client.pem"), KeyPEM: readClientCert(c, "client.key")},
+		{PKCS12: readClientCert(c, "client.pfx"), PKCS12Password: "Passw0rd"},
+		{Certificate: &pemCert, Cert: "ignored"},
+	} {
+		cert, err := creds.certificate()
+		c.Assert(err, gc.IsNil)
+		c.Assert(cert.Certificate[0], gc.DeepEquals, pemCert.Certificate[0])
+	}
+
+	creds := &CertificateCredentials{Cert: "testdata/clientcert/client.pem", Key: "testdata/clientcert/client-encrypted.key"}
+	_, err = creds.certificate()
+	c.Assert(err, gc.Equals, ErrEncryptedKey)
+}
+
+func (ClientCertSuite) TestCertAuthPKCS12(c *gc.C) {
+	authorities := x509.NewCertPool()
+	c.Assert(authorities.AppendCertsFromPEM(readClientCert(c, "ca.pem")), gc.Equals, true)
+	server := newUnstartedFakeWinRM()
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: authorities}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithCertAuth(&CertificateCredentials{
+		PKCS12:         readClientCert(c, "client.pfx"),
+		PKCS12Password: "Passw0rd",
+		CA:             writeCA(c, server),
+	}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+}
+
+func (ClientCertSuite) TestCertAuthRoundTripper(c *gc.C) {
+	authorities := x509.NewCertPool()
+	c.Assert(authorities.AppendCertsFromPEM(readClientCert(c, "ca.pem")), gc.Equals, true)
+	server := newUnstartedFakeWinRM()
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: authorities}
+	server.StartTLS()
+	defer server.Close()
+
+	// the certificate is presented through the transport of the caller
+	client, err := NewClient(server.URL, WithRoundTripper(&http.Transport{}), WithCertAuth(&CertificateCredentials{
+		PKCS12:         readClientCert(c, "client.pfx"),
+		PKCS12Password: "Passw0rd",
+		CA:             writeCA(c, server),
+	}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+}
@@ -0,0 +1,278 @@
+package winrm
+
+import (
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// clixmlHeader starts the stderr of PowerShell when it serializes its
+// streams
+const clixmlHeader = "#< CLIXML"
+
+// ErrorRecord is an error written by PowerShell to its error stream
+type ErrorRecord struct {
+	// Message is the error message, prefixed with the command that
+	// failed for errors written by a cmdlet
+	Message string
+	// Category is the CategoryInfo of the error, such as
+	// "ObjectNotFound: (C:\missing:String) [Get-Item], ItemNotFoundException"
+	Category string
+	// FullyQualifiedErrorId identifies the error, such as
+	// "PathNotFound,Microsoft.PowerShell.Commands.GetItemCommand"
+	FullyQualifiedErrorId string
+	// ScriptPosition locates the failure in the script, such as
+	// "At line:1 char:1" followed by the offending line
+	ScriptPosition string
+}
+
+// ProgressRecord is a progress update written by PowerShell
+type ProgressRecord struct {
+	Activity          string
+	StatusDescription string
+	CurrentOperation  string
+	ActivityId        int
+	ParentActivityId  int
+	PercentComplete   int
+	SecondsRemaining  int
+	// Completed is set on the last record of an activity
+	Completed bool
+}
+
+// PowerShellStreams are the streams PowerShell serialized on stderr
+type PowerShellStreams struct {
+	// Text is the human readable rendering of every stream but the
+	// progress one, as printed by a PowerShell console
+	Text     string
+	Errors   []ErrorRecord
+	Warnings []string
+	Verbose  []string
+	Debug    []string
+	Progress []ProgressRecord
+}
+
+// clixmlNode is any element of a CLIXML document
+type clixmlNode struct {
+	XMLName xml.Name
+	S       string       `xml:"S,attr"`
+	N       string       `xml:"N,attr"`
+	Text    string       `xml:",chardata"`
+	Nodes   []clixmlNode `xml:",any"`
+}
+
+// child returns the first child element named name, with the N attribute
+// n unless it is empty
+func (node *clixmlNode) child(name, n string) *clixmlNode {
+	for i := range node.Nodes {
+		child := &node.Nodes[i]
+		if child.XMLName.Local == name && (n == "" || child.N == n) {
+			return child
+		}
+	}
+	return nil
+}
+
+// property returns the text of the property n of the object node,
+// searching its nested objects as well
+func (node *clixmlNode) property(n string) string {
+	for i := range node.Nodes {
+		child := &node.Nodes[i]
+		if child.N == n {
+			return decodeCLIXMLString(child.Text)
+		}
+		if value := child.property(n); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// DecodeCLIXML decodes the stderr of PowerShell, which serializes its
+// error, warning, verbose, debug and progress streams as CLIXML when its
+// output is redirected. stderr that is not CLIXML is returned as the Text
+// of the result.
+func DecodeCLIXML(stderr string) (*PowerShellStreams, error) {
+	streams := &PowerShellStreams{}
+	if !strings.HasPrefix(stderr, clixmlHeader) {
+		streams.Text = stderr
+		return streams, nil
+	}
+
+	var text, errorText strings.Builder
+	// error lines come one per element and are split into records once
+	// all of them are known
+	flushErrors := func() {
+		if errorText.Len() > 0 {
+			streams.Errors = append(streams.Errors, parseErrorText(errorText.String())...)
+			errorText.Reset()
+		}
+	}
+	decoder := xml.NewDecoder(strings.NewReader(stderr[len(clixmlHeader):]))
+	for {
+		var objs clixmlNode
+		err := decoder.Decode(&objs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range objs.Nodes {
+			node := &objs.Nodes[i]
+			stream := strings.ToLower(node.S)
+			if stream != "error" {
+				flushErrors()
+			}
+			switch {
+			case stream == "progress":
+				streams.Progress = append(streams.Progress, parseProgress(node))
+			case stream == "error" && node.XMLName.Local == "Obj":
+				record := parseErrorObject(node)
+				streams.Errors = append(streams.Errors, record)
+				text.WriteString(strings.Replace(record.Message, "\n", "\r\n", -1) + "\r\n")
+				if record.ScriptPosition != "" {
+					text.WriteString(strings.Replace(record.ScriptPosition, "\n", "\r\n", -1) + "\r\n")
+				}
+			case stream == "error":
+				line := decodeCLIXMLString(node.Text)
+				errorText.WriteString(line)
+				text.WriteString(line)
+			case stream == "warning" || stream == "verbose" || stream == "debug":
+				line := strings.TrimRight(decodeCLIXMLString(node.Text), "\r\n")
+				switch stream {
+				case "warning":
+					streams.Warnings = append(streams.Warnings, line)
+				case "verbose":
+					streams.Verbose = append(streams.Verbose, line)
+				default:
+					streams.Debug = append(streams.Debug, line)
+				}
+				text.WriteString(strings.ToUpper(stream) + ": " + line + "\r\n")
+			default:
+				text.WriteString(decodeCLIXMLString(node.Text))
+			}
+		}
+	}
+	flushErrors()
+	streams.Text = strings.TrimRight(text.String(), " \r\n")
+	return streams, nil
+}
+
+var clixmlEscape = regexp.MustCompile(`(?:_x[0-9A-Fa-f]{4}_)+`)
+
+// decodeCLIXMLString decodes the _xHHHH_ escapes of the UTF-16 code units
+// that XML cannot hold, such as _x000D__x000A_ for a line break
+func decodeCLIXMLString(s string) string {
+	return clixmlEscape.ReplaceAllStringFunc(s, func(escapes string) string {
+		units := make([]uint16, 0, len(escapes)/7)
+		for i := 0; i+7 <= len(escapes); i += 7 {
+			unit, _ := strconv.ParseUint(escapes[i+2:i+6], 16, 16)
+			units = append(units, uint16(unit))
+		}
+		return string(utf16.Decode(units))
+	})
+}
+
+// parseErrorText splits the error text rendered by PowerShell into its
+// records, which end with their FullyQualifiedErrorId line
+func parseErrorText(text string) []ErrorRecord {
+	var records []ErrorRecord
+	var record *ErrorRecord
+	var message, position []string
+	end := func() {
+		if record != nil {
+			record.Message = strings.Join(message, "\n")
+			record.ScriptPosition = strings.Join(position, "\n")
+			records = append(records, *record)
+		}
+		record, message, position = nil, nil, nil
+	}
+	for _, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			end()
+			continue
+		}
+		if record == nil {
+			record = &ErrorRecord{}
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "+ CategoryInfo"):
+			record.Category = errorField(trimmed)
+		case strings.HasPrefix(trimmed, "+ FullyQualifiedErrorId"):
+			record.FullyQualifiedErrorId = errorField(trimmed)
+			end()
+		case strings.HasPrefix(line, "At ") && strings.Contains(line, " char:"):
+			position = append(position, line)
+		case len(position) > 0 && strings.HasPrefix(line, "+ "):
+			position = append(position, line)
+		default:
+			message = append(message, line)
+		}
+	}
+	end()
+	return records
+}
+
+// errorField returns the value of a "+ Name : value" line
+func errorField(line string) string {
+	if i := strings.Index(line, ":"); i >= 0 {
+		return strings.TrimSpace(line[i+1:])
+	}
+	return ""
+}
+
+// parseErrorObject reads a serialized ErrorRecord
+func parseErrorObject(node *clixmlNode) ErrorRecord {
+	// line breaks are normalized as for the records rendered as text
+	lines := strings.NewReplacer("\r\n", "\n")
+	record := ErrorRecord{
+		Category:              node.property("ErrorCategory_Message"),
+		FullyQualifiedErrorId: node.property("FullyQualifiedErrorId"),
+		ScriptPosition:        lines.Replace(strings.TrimSpace(node.property("InvocationInfo_PositionMessage"))),
+	}
+	if toString := node.child("ToString", ""); toString != nil {
+		record.Message = lines.Replace(strings.TrimSpace(decodeCLIXMLString(toString.Text)))
+	}
+	return record
+}
+
+// parseProgress reads a serialized progress record, whose fields are
+// stored in order under its Record property
+func parseProgress(node *clixmlNode) ProgressRecord {
+	var record ProgressRecord
+	ms := node.child("MS", "")
+	if ms == nil {
+		return record
+	}
+	pr := ms.child("PR", "Record")
+	if pr == nil {
+		return record
+	}
+	for _, field := range pr.Nodes {
+		value := decodeCLIXMLString(field.Text)
+		number, _ := strconv.Atoi(value)
+		switch field.XMLName.Local {
+		case "AV":
+			record.Activity = value
+		case "AI":
+			record.ActivityId = number
+		case "S":
+			record.CurrentOperation = value
+		case "PI":
+			record.ParentActivityId = number
+		case "PC":
+			record.PercentComplete = number
+		case "T":
+			record.Completed = value == "Completed"
+		case "SR":
+			record.SecondsRemaining = number
+		case "SD":
+			record.StatusDescription = value
+		}
+	}
+	return record
+}
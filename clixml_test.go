@@ -0,0 +1,86 @@
+package winrm
+
+import (
+	"io/ioutil"
+
+	gc "launchpad.net/gocheck"
+)
+
+type CLIXMLSuite struct{}
+
+var _ = gc.Suite(CLIXMLSuite{})
+
+func (CLIXMLSuite) TestDecodeCLIXML(c *gc.C) {
+	stderr, err := ioutil.ReadFile("testdata/clixml/errors.txt")
+	c.Assert(err, gc.IsNil)
+	streams, err := DecodeCLIXML(string(stderr))
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(streams.Errors, gc.DeepEquals, []ErrorRecord{{
+		Message:               `Get-Item : Cannot find path 'C:\missing' because it does not exist.`,
+		Category:              `ObjectNotFound: (C:\missing:String) [Get-Item], ItemNotFoundException`,
+		FullyQualifiedErrorId: "PathNotFound,Microsoft.PowerShell.Commands.GetItemCommand",
+		ScriptPosition:        "At line:1 char:1\n+ Get-Item C:\\missing\n+ ~~~~~~~~~~~~~~~~~~~",
+	}, {
+		Message:               "boom",
+		Category:              "OperationStopped: (boom:String) [], RuntimeException",
+		FullyQualifiedErrorId: "boom",
+		ScriptPosition:        "At C:\\scripts\\deploy.ps1:12 char:5\n+     throw \"boom\"\n+     ~~~~~~~~~~~~",
+	}})
+	c.Assert(streams.Progress, gc.DeepEquals, []ProgressRecord{{
+		Activity:          "Preparing modules for first use.",
+		StatusDescription: " ",
+		ParentActivityId:  -1,
+		PercentComplete:   -1,
+		SecondsRemaining:  -1,
+		Completed:         true,
+	}})
+	c.Assert(streams.Warnings, gc.DeepEquals, []string{"Disk C: is almost full"})
+	// an escaped underscore keeps what follows from being decoded
+	c.Assert(streams.Verbose, gc.DeepEquals, []string{"Done_x000A_"})
+	c.Assert(streams.Text, gc.Equals, "WARNING: Disk C: is almost full\r\n"+
+		"Get-Item : Cannot find path 'C:\\missing' because it does not exist.\r\n"+
+		"At line:1 char:1\r\n"+
+		"+ Get-Item C:\\missing\r\n"+
+		"+ ~~~~~~~~~~~~~~~~~~~\r\n"+
+		"    + CategoryInfo          : ObjectNotFound: (C:\\missing:String) [Get-Item], ItemNotFoundException\r\n"+
+		"    + FullyQualifiedErrorId : PathNotFound,Microsoft.PowerShell.Commands.GetItemCommand\r\n"+
+		" \r\n"+
+		"boom\r\n"+
+		"At C:\\scripts\\deploy.ps1:12 char:5\r\n"+
+		"+     throw \"boom\"\r\n"+
+		"+     ~~~~~~~~~~~~\r\n"+
+		"    + CategoryInfo          : OperationStopped: (boom:String) [], RuntimeException\r\n"+
+		"    + FullyQualifiedErrorId : boom\r\n"+
+		" \r\n"+
+		"VERBOSE: Done_x000A_")
+}
+
+func (CLIXMLSuite) TestDecodeCLIXMLErrorObject(c *gc.C) {
+	stderr := "#< CLIXML\r\n" + `<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04"><Obj S="Error" RefId="0"><TN RefId="0"><T>System.Management.Automation.ErrorRecord</T><T>System.Object</T></TN><ToString>Access is denied_x000D__x000A_</ToString><MS><Obj N="Exception" RefId="1"><ToString>System.UnauthorizedAccessException: Access is denied</ToString></Obj><S N="FullyQualifiedErrorId">UnauthorizedAccess</S><S N="ErrorCategory_Message">PermissionDenied: (:) [], UnauthorizedAccessException</S><S N="InvocationInfo_PositionMessage">At line:3 char:1_x000D__x000A_+ Remove-Item C:\Windows</S></MS></Obj></Objs>`
+	streams, err := DecodeCLIXML(stderr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(streams.Errors, gc.DeepEquals, []ErrorRecord{{
+		Message:               "Access is denied",
+		Category:              "PermissionDenied: (:) [], UnauthorizedAccessException",
+		FullyQualifiedErrorId: "UnauthorizedAccess",
+		ScriptPosition:        "At line:3 char:1\n+ Remove-Item C:\\Windows",
+	}})
+	c.Assert(streams.Text, gc.Equals, "Access is denied\r\nAt line:3 char:1\r\n+ Remove-Item C:\\Windows")
+}
+
+func (CLIXMLSuite) TestDecodeCLIXMLPlain(c *gc.C) {
+	streams, err := DecodeCLIXML("The system cannot find the path specified.\r\n")
+	c.Assert(err, gc.IsNil)
+	c.Assert(streams, gc.DeepEquals, &PowerShellStreams{Text: "The system cannot find the path specified.\r\n"})
+
+	_, err = DecodeCLIXML("#< CLIXML\r\n<Objs><S S=\"Error\">cut")
+	c.Assert(err, gc.NotNil)
+}
+
+func (CLIXMLSuite) TestDecodeCLIXMLString(c *gc.C) {
+	c.Assert(decodeCLIXMLString("a_x000D__x000A_b"), gc.Equals, "a\r\nb")
+	// surrogate pairs are escaped unit by unit
+	c.Assert(decodeCLIXMLString("_xD83D__xDE00_"), gc.Equals, "😀")
+	c.Assert(decodeCLIXMLString("snake_case_x"), gc.Equals, "snake_case_x")
+}
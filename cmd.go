@@ -0,0 +1,314 @@
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Cmd is a command being prepared or run on the remote host, modeled on
+// os/exec.Cmd. Unless Shell is set, it runs in a shell of its own,
+// created by Start and deleted by Wait.
+type Cmd struct {
+	// Path is the executable to run. It is started directly rather than
+	// through cmd.exe, so that builtins such as dir need to be run as
+	// cmd /c dir.
+	Path string
+	// Args holds the command line, including the command as Args[0].
+	// Args[1:] are quoted so that the command receives them unchanged.
+	Args []string
+	// Dir is the working directory of the command, and Env its
+	// environment as key=value pairs added to that of the shell.
+	// Neither can be set for a command run in an existing Shell.
+	Dir string
+	Env []string
+	// Stdin, Stdout and Stderr are the streams of the command. A nil
+	// Stdin gives the command no input, a nil Stdout or Stderr discards
+	// that output.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Shell, when set, is the shell the command runs in
+	Shell *RemoteShell
+
+	client *Client
+	ctx    context.Context
+	// owned is the shell created for the command by Start
+	owned     *RemoteShell
+	shellID   string
+	commandID string
+	done      chan struct{}
+	exitCode  int
+	err       error
+	// closers are closed once the command has exited
+	closers []io.Closer
+	waited  bool
+	mu      sync.Mutex
+}
+
+// ExitError reports a command that exited with a non zero code
+type ExitError struct {
+	code int
+	// Stderr holds the error output of the command if it was collected
+	// by Cmd.Output
+	Stderr []byte
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// ExitCode returns the exit code of the command
+func (e *ExitError) ExitCode() int {
+	return e.code
+}
+
+// Command returns the Cmd to run name with the given arguments
+func (c *Client) Command(name string, arg ...string) *Cmd {
+	return c.CommandContext(context.Background(), name, arg...)
+}
+
+// CommandContext is like Command, but the command is terminated if ctx is
+// done before it exits
+func (c *Client) CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
+	return &Cmd{
+		Path:   name,
+		Args:   append([]string{name}, arg...),
+		client: c,
+		ctx:    ctx,
+	}
+}
+
+// Command returns the Cmd to run name with the given arguments in shell
+func (shell *RemoteShell) Command(name string, arg ...string) *Cmd {
+	return shell.CommandContext(context.Background(), name, arg...)
+}
+
+// CommandContext is like Command, but the command is terminated if ctx is
+// done before it exits
+func (shell *RemoteShell) CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
+	cmd := shell.client.CommandContext(ctx, name, arg...)
+	cmd.Shell = shell
+	return cmd
+}
+
+// params returns the command line of cmd for shellID
+func (cmd *Cmd) params(shellID string) CmdParams {
+	params := CmdParams{ShellID: shellID, Cmd: EscapeArg(cmd.Path), SkipCmdShell: true}
+	if len(cmd.Args) > 1 {
+		params.Args = JoinArgs(cmd.Args[1:])
+	}
+	return params
+}
+
+// environment converts Env to the variables of a new shell
+func (cmd *Cmd) environment() (*Environment, error) {
+	if len(cmd.Env) == 0 {
+		return nil, nil
+	}
+	env := &Environment{}
+	for _, pair := range cmd.Env {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid environment variable: %q", pair))
+		}
+		var value bytes.Buffer
+		if err := xml.EscapeText(&value, []byte(pair[i+1:])); err != nil {
+			return nil, err
+		}
+		env.Variable = append(env.Variable, EnvVariable{Name: pair[:i], Value: value.String()})
+	}
+	return env, nil
+}
+
+// Start starts the command without waiting for it to exit. Wait must be
+// called to release the resources of the command.
+func (cmd *Cmd) Start() error {
+	if cmd.done != nil {
+		return errors.New("Cmd already started")
+	}
+	if cmd.Path == "" {
+		return errors.New("Invalid command")
+	}
+	shell := cmd.Shell
+	if shell != nil {
+		cmd.client = shell.client
+	}
+	if cmd.client == nil {
+		return errors.New("Cmd has no Client nor Shell to run in")
+	}
+	if cmd.ctx == nil {
+		cmd.ctx = context.Background()
+	}
+	if shell == nil {
+		env, err := cmd.environment()
+		if err != nil {
+			cmd.closeAll()
+			return err
+		}
+		shell, err = cmd.client.NewShell(cmd.ctx, ShellParams{WorkingDir: cmd.Dir, EnvVars: env})
+		if err != nil {
+			cmd.closeAll()
+			return err
+		}
+		cmd.owned = shell
+	} else if cmd.Dir != "" || len(cmd.Env) > 0 {
+		cmd.closeAll()
+		return errors.New("Dir and Env cannot be set for a command of an existing shell")
+	}
+
+	commandID, err := shell.Run(cmd.ctx, cmd.params(shell.ID))
+	if err != nil {
+		cmd.closeShell()
+		cmd.closeAll()
+		return err
+	}
+	cmd.shellID = shell.ID
+	cmd.commandID = commandID
+	cmd.done = make(chan struct{})
+	go func() {
+		cmd.exitCode, cmd.err = cmd.client.communicate(cmd.ctx, shell.ID, commandID, cmd.Stdin, cmd.Stdout, cmd.Stderr)
+		// readers of StdoutPipe get io.EOF once the command exited
+		cmd.closeAll()
+		close(cmd.done)
+	}()
+	return nil
+}
+
+// Wait waits for the started command to exit and its output to be
+// copied. The error is an *ExitError if the command ran and exited with a
+// non zero code.
+func (cmd *Cmd) Wait() error {
+	if cmd.done == nil {
+		return errors.New("Cmd not started")
+	}
+	cmd.mu.Lock()
+	if cmd.waited {
+		cmd.mu.Unlock()
+		return errors.New("Wait was already called")
+	}
+	cmd.waited = true
+	cmd.mu.Unlock()
+
+	<-cmd.done
+	if err := cmd.closeShell(); err != nil && cmd.err == nil {
+		cmd.err = err
+	}
+	if cmd.err != nil {
+		return cmd.err
+	}
+	if cmd.exitCode != 0 {
+		return &ExitError{code: cmd.exitCode}
+	}
+	return nil
+}
+
+// Signal sends the signal code, such as ctrl_c, to the started command
+func (cmd *Cmd) Signal(code string) error {
+	if cmd.done == nil {
+		return errors.New("Cmd not started")
+	}
+	return cmd.client.Signal(cmd.ctx, cmd.shellID, cmd.commandID, code)
+}
+
+// Run starts the command and waits for it to exit
+func (cmd *Cmd) Run() error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// Output runs the command and returns its standard output. If Stderr was
+// not set, the error output is collected into the ExitError.
+func (cmd *Cmd) Output() ([]byte, error) {
+	if cmd.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	captureErr := cmd.Stderr == nil
+	if captureErr {
+		cmd.Stderr = &stderr
+	}
+	err := cmd.Run()
+	if exitErr, ok := err.(*ExitError); ok && captureErr {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// error output interleaved
+func (cmd *Cmd) CombinedOutput() ([]byte, error) {
+	if cmd.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	if cmd.Stderr != nil {
+		return nil, errors.New("Stderr already set")
+	}
+	// both streams are written by the same goroutine
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.Bytes(), err
+}
+
+// StdinPipe returns a pipe connected to the input of the command once it
+// starts. Closing the pipe ends the input; it is closed anyway once the
+// command has exited.
+func (cmd *Cmd) StdinPipe() (io.WriteCloser, error) {
+	if cmd.Stdin != nil {
+		return nil, errors.New("Stdin already set")
+	}
+	if cmd.done != nil {
+		return nil, errors.New("StdinPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	cmd.Stdin = pr
+	cmd.closers = append(cmd.closers, pr)
+	return pw, nil
+}
+
+// StdoutPipe returns a pipe connected to the output of the command once
+// it starts. As the output is not buffered, it must be read to completion,
+// until io.EOF once the command exited, before calling Wait.
+func (cmd *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if cmd.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	if cmd.done != nil {
+		return nil, errors.New("StdoutPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.closers = append(cmd.closers, pw)
+	return pr, nil
+}
+
+// closeAll closes the pipes of the command
+func (cmd *Cmd) closeAll() {
+	for _, closer := range cmd.closers {
+		closer.Close()
+	}
+	cmd.closers = nil
+}
+
+// closeShell deletes the shell created by Start, independently of the
+// context of the command
+func (cmd *Cmd) closeShell() error {
+	if cmd.owned == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+	defer cancel()
+	err := cmd.owned.Close(ctx)
+	cmd.owned = nil
+	return err
+}
@@ -0,0 +1,84 @@
+// Command winrm-known-hosts manages the known hosts file trusting the
+// certificates of WinRM listeners:
+//
+//	winrm-known-hosts [-f file] scan <endpoint>
+//	winrm-known-hosts [-f file] accept <endpoint>
+//	winrm-known-hosts [-f file] remove <endpoint>
+//
+// scan prints the fingerprint of the certificate of the listener and how
+// it compares to the recorded one, accept records it in place of any
+// other, and remove forgets the listener.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/trobert2/winrm"
+)
+
+func main() {
+	home, _ := os.UserHomeDir()
+	path := flag.String("f", filepath.Join(home, ".winrm", "known_hosts"), "known hosts file")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-f file] scan|accept|remove <endpoint>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(winrm.NewKnownHosts(*path), flag.Arg(0), flag.Arg(1)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(knownHosts *winrm.KnownHosts, command, endpoint string) error {
+	if command != "scan" && command != "accept" && command != "remove" {
+		return errors.New(fmt.Sprintf("Unknown command %q", command))
+	}
+	host, err := winrm.EndpointHost(endpoint)
+	if err != nil {
+		return err
+	}
+	if command == "remove" {
+		return knownHosts.Remove(host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cert, err := winrm.FetchCertificate(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+	presented := winrm.Fingerprint(cert)
+	known, found, err := knownHosts.Lookup(host)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", host, presented)
+	fmt.Printf("  subject: %s\n  issuer:  %s\n  expires: %s\n", cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	switch {
+	case !found:
+		fmt.Println("  not recorded yet")
+	case known == presented:
+		fmt.Println("  matches the recorded certificate")
+	default:
+		fmt.Printf("  CHANGED, recorded: %s\n", known)
+	}
+	if command == "scan" || known == presented {
+		return nil
+	}
+	if err := knownHosts.Accept(host, presented); err != nil {
+		return err
+	}
+	fmt.Printf("  accepted into %s\n", knownHosts.Path)
+	return nil
+}
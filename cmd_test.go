@@ -0,0 +1,163 @@
+package winrm
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	gc "launchpad.net/gocheck"
+)
+
+type CmdSuite struct{}
+
+var _ = gc.Suite(CmdSuite{})
+
+// receiveDone answers a Receive with the output of a command exiting with
+// exitCode
+func receiveDone(stdout, stderr string, exitCode int) string {
+	return fmt.Sprintf(`<rsp:ReceiveResponse><rsp:Stream Name="stdout" CommandId="1" End="true">%s</rsp:Stream><rsp:Stream Name="stderr" CommandId="1" End="true">%s</rsp:Stream><rsp:CommandState CommandId="1" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"><rsp:ExitCode>%d</rsp:ExitCode></rsp:CommandState></rsp:ReceiveResponse>`,
+		base64.StdEncoding.EncodeToString([]byte(stdout)), base64.StdEncoding.EncodeToString([]byte(stderr)), exitCode)
+}
+
+func (CmdSuite) TestCmdOutput(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{receiveDone("hello\r\n", "", 0)}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	cmd := client.Command("cmd", "/c", "echo", "hello")
+	cmd.Dir = `C:\Temp`
+	cmd.Env = []string{"GREETING=a&b"}
+	output, err := cmd.Output()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(output), gc.Equals, "hello\r\n")
+
+	// the command ran in a shell of its own, deleted once it exited
+	c.Assert(server.seen(), gc.DeepEquals, []string{"transfer/Create", "shell/Command", "shell/Receive", "transfer/Delete"})
+	created := server.received("transfer/Create")[0]
+	c.Assert(created, gc.Matches, `(?s).*<rsp:WorkingDirectory>C:\\Temp</rsp:WorkingDirectory>.*`)
+	c.Assert(created, gc.Matches, `(?s).*<rsp:Variable Name="GREETING">a&amp;b</rsp:Variable>.*`)
+	command := server.received("shell/Command")[0]
+	c.Assert(command, gc.Matches, `(?s).*<rsp:Command>cmd</rsp:Command>\s*<rsp:Arguments>/c echo hello</rsp:Arguments>.*`)
+	c.Assert(command, gc.Matches, `(?s).*<w:Option Name="WINRS_SKIP_CMD_SHELL">TRUE</w:Option>.*`)
+}
+
+func (CmdSuite) TestCmdQuotesArgs(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{receiveDone("", "", 0)}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	err = client.Command(`C:\Program Files\Tool\tool.exe`, "--name", `say "hi" & 50%`).Run()
+	c.Assert(err, gc.IsNil)
+	command := server.received("shell/Command")[0]
+	c.Assert(command, gc.Matches, `(?s).*<rsp:Command>&#34;C:\\Program Files\\Tool\\tool.exe&#34;</rsp:Command>.*`)
+	c.Assert(command, gc.Matches, `(?s).*<rsp:Arguments>--name &#34;say \\&#34;hi\\&#34; &amp; 50%&#34;</rsp:Arguments>.*`)
+}
+
+func (CmdSuite) TestCmdExitError(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{receiveDone("", "not found\r\n", 1)}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	_, err = client.Command("where", "missing").Output()
+	c.Assert(err, gc.ErrorMatches, "exit status 1")
+	exitErr, ok := err.(*ExitError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(exitErr.ExitCode(), gc.Equals, 1)
+	c.Assert(string(exitErr.Stderr), gc.Equals, "not found\r\n")
+}
+
+func (CmdSuite) TestCmdCombinedOutput(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{receiveDone("out\r\n", "err\r\n", 0)}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	output, err := client.Command("whoami").CombinedOutput()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(output), gc.Equals, "out\r\nerr\r\n")
+}
+
+func (CmdSuite) TestCmdPipes(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	// the command only finishes once the end of its input was sent
+	gotInput := make(chan struct{})
+	server.hook = func(action string) {
+		switch action {
+		case "shell/Send":
+			if len(server.received("shell/Send")) == 2 {
+				close(gotInput)
+			}
+		case "shell/Receive":
+			<-gotInput
+		}
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	cmd := client.Command("findstr", "x")
+	stdin, err := cmd.StdinPipe()
+	c.Assert(err, gc.IsNil)
+	stdout, err := cmd.StdoutPipe()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmd.Start(), gc.IsNil)
+	_, err = cmd.StdinPipe()
+	c.Assert(err, gc.ErrorMatches, "Stdin already set")
+	c.Assert(cmd.Start(), gc.ErrorMatches, "Cmd already started")
+
+	_, err = io.WriteString(stdin, "xyz")
+	c.Assert(err, gc.IsNil)
+	c.Assert(stdin.Close(), gc.IsNil)
+	output, err := ioutil.ReadAll(stdout)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(output), gc.Equals, "such great")
+	c.Assert(cmd.Wait(), gc.ErrorMatches, "exit status 3")
+	c.Assert(cmd.Wait(), gc.ErrorMatches, "Wait was already called")
+
+	sent := server.received("shell/Send")
+	c.Assert(sent[0], gc.Matches, `(?s).*<rsp:Stream Name="stdin" CommandId="6D0A426F-4B4A-44F8-AF20-C35365258FEB">eHl6</rsp:Stream>.*`)
+}
+
+func (CmdSuite) TestCmdInShell(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{receiveDone("", "", 0), receiveDone("", "", 0)}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+	shell, err := client.NewShell(ctx, ShellParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(shell.Command("whoami").Run(), gc.IsNil)
+	c.Assert(shell.CommandContext(ctx, "whoami").Run(), gc.IsNil)
+
+	cmd := shell.Command("whoami")
+	cmd.Dir = `C:\Temp`
+	c.Assert(cmd.Run(), gc.ErrorMatches, "Dir and Env cannot be set for a command of an existing shell")
+	c.Assert(shell.Close(ctx), gc.IsNil)
+
+	c.Assert(server.received("transfer/Create"), gc.HasLen, 1)
+	c.Assert(server.received("shell/Command"), gc.HasLen, 2)
+	c.Assert(server.received("transfer/Delete"), gc.HasLen, 1)
+}
+
+func (CmdSuite) TestCmdInvalid(c *gc.C) {
+	cmd := &Cmd{Path: "whoami"}
+	c.Assert(cmd.Run(), gc.ErrorMatches, "Cmd has no Client nor Shell to run in")
+	c.Assert(cmd.Wait(), gc.ErrorMatches, "Cmd not started")
+
+	client, err := NewClient("http://127.0.0.1:1/wsman")
+	c.Assert(err, gc.IsNil)
+	cmd = client.Command("whoami")
+	cmd.Env = []string{"NOVALUE"}
+	c.Assert(cmd.Run(), gc.ErrorMatches, `Invalid environment variable: "NOVALUE"`)
+}
@@ -0,0 +1,367 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// credsspVersion is the CredSSP protocol version announced to servers,
+// MS-CSSP 2.2.1
+const credsspVersion = 6
+
+// credsspTrailerLength is the length of the AES-GCM tag ending the TLS
+// records that seal messages. It is announced as the signature length of
+// encrypted messages.
+const credsspTrailerLength = 16
+
+// credsspCipherSuites are the only cipher suites offered to the server, as
+// they give TLS records a fixed trailer length
+var credsspCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// tsRequest is the TSRequest structure carried by the TLS channel,
+// MS-CSSP 2.2.1
+type tsRequest struct {
+	Version     int         `asn1:"explicit,tag:0"`
+	NegoTokens  []negoToken `asn1:"optional,explicit,tag:1"`
+	AuthInfo    []byte      `asn1:"optional,explicit,tag:2"`
+	PubKeyAuth  []byte      `asn1:"optional,explicit,tag:3"`
+	ErrorCode   int64       `asn1:"optional,explicit,tag:4"`
+	ClientNonce []byte      `asn1:"optional,explicit,tag:5"`
+}
+
+type negoToken struct {
+	Token []byte `asn1:"explicit,tag:0"`
+}
+
+// tsCredentials are the credentials delegated to the server, MS-CSSP
+// 2.2.1.2
+type tsCredentials struct {
+	CredType    int    `asn1:"explicit,tag:0"`
+	Credentials []byte `asn1:"explicit,tag:1"`
+}
+
+type tsPasswordCreds struct {
+	DomainName []byte `asn1:"explicit,tag:0"`
+	UserName   []byte `asn1:"explicit,tag:1"`
+	Password   []byte `asn1:"explicit,tag:2"`
+}
+
+// credsspBinding returns the hash binding the public key of the server to
+// the NTLM context, MS-CSSP 3.1.5.1.1
+func credsspBinding(magic string, nonce, pubKey []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(magic))
+	hash.Write(nonce)
+	hash.Write(pubKey)
+	return hash.Sum(nil)
+}
+
+// tlsTunnel is the transport of a TLS connection whose records travel in
+// the headers and bodies of HTTP messages rather than on a socket. Records
+// written by the TLS connection are kept until taken, records received
+// are queued for it to read.
+type tlsTunnel struct {
+	in  bytes.Buffer
+	out bytes.Buffer
+	// flush and feed relay records while step runs a handshake
+	flush chan []byte
+	feed  chan []byte
+}
+
+func (t *tlsTunnel) Read(p []byte) (int, error) {
+	if t.in.Len() == 0 {
+		if t.flush == nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		t.flush <- t.take()
+		records, ok := <-t.feed
+		if !ok {
+			return 0, io.EOF
+		}
+		t.in.Write(records)
+	}
+	return t.in.Read(p)
+}
+
+func (t *tlsTunnel) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+// take returns the records written since the last call
+func (t *tlsTunnel) take() []byte {
+	records := make([]byte, t.out.Len())
+	copy(records, t.out.Bytes())
+	t.out.Reset()
+	return records
+}
+
+// step runs fn, which drives the TLS connection, until it returns. Each
+// time the connection waits for records, those it wrote are passed to
+// exchange which returns the records of the peer.
+func (t *tlsTunnel) step(fn func() error, exchange func([]byte) ([]byte, error)) error {
+	t.flush, t.feed = make(chan []byte), make(chan []byte)
+	defer func() { t.flush, t.feed = nil, nil }()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	for {
+		select {
+		case records := <-t.flush:
+			reply, err := exchange(records)
+			if err != nil {
+				close(t.feed)
+				<-done
+				return err
+			}
+			t.feed <- reply
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+func (t *tlsTunnel) Close() error                     { return nil }
+func (t *tlsTunnel) LocalAddr() net.Addr              { return tunnelAddr{} }
+func (t *tlsTunnel) RemoteAddr() net.Addr             { return tunnelAddr{} }
+func (t *tlsTunnel) SetDeadline(time.Time) error      { return nil }
+func (t *tlsTunnel) SetReadDeadline(time.Time) error  { return nil }
+func (t *tlsTunnel) SetWriteDeadline(time.Time) error { return nil }
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "credssp" }
+func (tunnelAddr) String() string  { return "credssp" }
+
+// credsspSession is the TLS channel set up by a CredSSP handshake. Once
+// the credentials are delegated it seals the messages of the connection.
+type credsspSession struct {
+	tunnel *tlsTunnel
+	conn   *tls.Conn
+}
+
+func newCredSSPSession() *credsspSession {
+	tunnel := &tlsTunnel{}
+	return &credsspSession{
+		tunnel: tunnel,
+		// the server is authenticated by the public key binding rather
+		// than by its certificate
+		conn: tls.Client(tunnel, &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       credsspCipherSuites,
+		}),
+	}
+}
+
+// send returns the TLS records carrying msg
+func (session *credsspSession) send(msg []byte) ([]byte, error) {
+	if _, err := session.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	return session.tunnel.take(), nil
+}
+
+// receive returns the data carried by the TLS records
+func (session *credsspSession) receive(records []byte) ([]byte, error) {
+	count := 0
+	for rest := records; len(rest) >= 5; {
+		length := 5 + int(rest[3])<<8 + int(rest[4])
+		if length > len(rest) {
+			break
+		}
+		if rest[0] == 23 {
+			count++
+		}
+		rest = rest[length:]
+	}
+	session.tunnel.in.Write(records)
+	var msg []byte
+	buf := make([]byte, 16384)
+	for i := 0; i < count; i++ {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid CredSSP message: %v", err))
+		}
+		msg = append(msg, buf[:n]...)
+	}
+	return msg, nil
+}
+
+// Wrap seals msg, which must fit in a single TLS record. The signature
+// is the start of the record, as the whole record is sent.
+func (session *credsspSession) Wrap(msg []byte) ([]byte, []byte, error) {
+	record, err := session.send(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(record) < credsspTrailerLength {
+		return nil, nil, errors.New("Invalid CredSSP message")
+	}
+	return record[:credsspTrailerLength], record[credsspTrailerLength:], nil
+}
+
+// Unwrap decrypts the TLS records split by Wrap
+func (session *credsspSession) Unwrap(signature, sealed []byte) ([]byte, error) {
+	return session.receive(append(append([]byte{}, signature...), sealed...))
+}
+
+// request seals req and passes it to exchange, returning the TSRequest
+// sent back by the server
+func (session *credsspSession) request(req *tsRequest, exchange func([]byte) ([]byte, error)) (*tsRequest, error) {
+	msg, err := asn1.Marshal(*req)
+	if err != nil {
+		return nil, err
+	}
+	records, err := session.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := exchange(records)
+	if err != nil {
+		return nil, err
+	}
+	msg, err = session.receive(reply)
+	if err != nil {
+		return nil, err
+	}
+	resp := &tsRequest{}
+	if _, err := asn1.Unmarshal(msg, resp); err != nil {
+		return nil, errors.New("Invalid CredSSP TSRequest")
+	}
+	if resp.ErrorCode != 0 {
+		return nil, errors.New(fmt.Sprintf("CredSSP authentication failed with error code 0x%08x", uint32(resp.ErrorCode)))
+	}
+	return resp, nil
+}
+
+// authenticate runs the CredSSP handshake through exchange, which sends
+// records to the server and returns its reply. It returns the final
+// records delegating the credentials, which the server answers without
+// a token.
+func (session *credsspSession) authenticate(username, password string, exchange func([]byte) ([]byte, error)) ([]byte, error) {
+	if err := session.tunnel.step(session.conn.Handshake, exchange); err != nil {
+		return nil, err
+	}
+	pubKey, err := session.serverPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := session.request(&tsRequest{
+		Version:    credsspVersion,
+		NegoTokens: []negoToken{{ntlmNegotiateMessage()}},
+	}, exchange)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.NegoTokens) == 0 {
+		return nil, errors.New("CredSSP handshake failed: no NTLM challenge")
+	}
+	challenge, err := parseNTLMChallenge(resp.NegoTokens[0].Token)
+	if err != nil {
+		return nil, err
+	}
+	msg, ntlm, err := ntlmAuthenticateMessage(username, password, challenge, time.Now(), ntlmRandom)
+	if err != nil {
+		return nil, err
+	}
+	if ntlm.Flags&ntlmNegotiateSeal == 0 {
+		return nil, errors.New("NTLM server does not support message encryption")
+	}
+
+	// servers from version 5 on bind the public key through a hash
+	// salted with a client nonce
+	version := resp.Version
+	req := &tsRequest{Version: credsspVersion, NegoTokens: []negoToken{{msg}}}
+	clientBinding := pubKey
+	if version >= 5 {
+		req.ClientNonce = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, req.ClientNonce); err != nil {
+			return nil, err
+		}
+		clientBinding = credsspBinding("CredSSP Client-To-Server Binding Hash\x00", req.ClientNonce, pubKey)
+	}
+	signature, sealed, err := ntlm.Wrap(clientBinding)
+	if err != nil {
+		return nil, err
+	}
+	req.PubKeyAuth = append(signature, sealed...)
+	resp, err = session.request(req, exchange)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.PubKeyAuth) < 16 {
+		return nil, errors.New("CredSSP server public key binding mismatch")
+	}
+	serverBinding, err := ntlm.Unwrap(resp.PubKeyAuth[:16], resp.PubKeyAuth[16:])
+	if err != nil {
+		return nil, err
+	}
+	expected := append([]byte{pubKey[0] + 1}, pubKey[1:]...)
+	if version >= 5 {
+		expected = credsspBinding("CredSSP Server-To-Client Binding Hash\x00", req.ClientNonce, pubKey)
+	}
+	if !bytes.Equal(serverBinding, expected) {
+		return nil, errors.New("CredSSP server public key binding mismatch")
+	}
+
+	user, domain := ntlmUserDomain(username)
+	creds, err := asn1.Marshal(tsPasswordCreds{
+		DomainName: utf16le(domain),
+		UserName:   utf16le(user),
+		Password:   utf16le(password),
+	})
+	if err != nil {
+		return nil, err
+	}
+	creds, err = asn1.Marshal(tsCredentials{CredType: 1, Credentials: creds})
+	if err != nil {
+		return nil, err
+	}
+	signature, sealed, err = ntlm.Wrap(creds)
+	if err != nil {
+		return nil, err
+	}
+	msg, err = asn1.Marshal(tsRequest{Version: credsspVersion, AuthInfo: append(signature, sealed...)})
+	if err != nil {
+		return nil, err
+	}
+	return session.send(msg)
+}
+
+// serverPublicKey returns the SubjectPublicKey of the server certificate
+func (session *credsspSession) serverPublicKey() ([]byte, error) {
+	certs := session.conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("CredSSP server sent no certificate")
+	}
+	return subjectPublicKey(certs[0].RawSubjectPublicKeyInfo)
+}
+
+// subjectPublicKey extracts the public key of a SubjectPublicKeyInfo
+func subjectPublicKey(spki []byte) ([]byte, error) {
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(spki, &info); err != nil || len(info.PublicKey.Bytes) == 0 {
+		return nil, errors.New("CredSSP server sent an invalid certificate")
+	}
+	return info.PublicKey.Bytes, nil
+}
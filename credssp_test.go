@@ -0,0 +1,383 @@
+package winrm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	gc "launchpad.net/gocheck"
+)
+
+type CredSSPSuite struct{}
+
+var _ = gc.Suite(CredSSPSuite{})
+
+// statusLogonFailure is STATUS_LOGON_FAILURE, 0xc000006d, as the signed
+// integer sent in the errorCode of a TSRequest
+const statusLogonFailure = -0x3fffff93
+
+// credsspCertificate returns a self-signed certificate for the TLS channel
+// of the CredSSP server
+func credsspCertificate(c *gc.C) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "WINHOST"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, gc.IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// credsspConn is the server side of the CredSSP handshake of a connection
+type credsspConn struct {
+	session       *credsspSession
+	handshake     chan error
+	ntlm          *ntlmSession
+	authenticated bool
+}
+
+// credsspServer emulates the CredSSP authentication of a WinRM listener.
+// It runs the TLS handshake and the NTLM exchange carried by the
+// Authorization headers of a connection, then echoes the messages sent
+// on it. Plain http connections must seal their messages.
+type credsspServer struct {
+	*httptest.Server
+	c        *gc.C
+	password string
+	cert     tls.Certificate
+	// version is the CredSSP version announced by the server
+	version int
+	// badBinding makes the server send a wrong public key binding
+	badBinding bool
+	mu         sync.Mutex
+	conns      map[string]*credsspConn
+	handshakes int
+	// delegated holds the credentials delegated by clients, as
+	// domain\user:password
+	delegated []string
+	// raw holds the bodies of the messages posted after authentication
+	raw []string
+}
+
+func newCredSSPServer(c *gc.C, password string, tls bool) *credsspServer {
+	s := &credsspServer{
+		c:        c,
+		password: password,
+		cert:     credsspCertificate(c),
+		version:  credsspVersion,
+		conns:    make(map[string]*credsspConn),
+	}
+	if tls {
+		s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	} else {
+		s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	}
+	return s
+}
+
+func (s *credsspServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn := s.conns[r.RemoteAddr]
+	auth := r.Header.Get("Authorization")
+	switch {
+	case auth == "" && conn != nil && conn.authenticated:
+		s.raw = append(s.raw, string(body))
+		if r.TLS != nil {
+			w.Write(body)
+			return
+		}
+		msg, err := decryptMessage(conn.session, body)
+		s.c.Assert(err, gc.IsNil)
+		s.c.Assert(r.Header.Get("Content-Type"), gc.Equals, encryptedContentType(credsspEncryptedProtocol, len(msg)))
+		reply, err := encryptMessage(conn.session, credsspEncryptedProtocol, msg)
+		s.c.Assert(err, gc.IsNil)
+		w.Header().Set("Content-Type", encryptedContentType(credsspEncryptedProtocol, len(msg)))
+		w.Write(reply)
+	case strings.HasPrefix(auth, "CredSSP "):
+		token, err := base64.StdEncoding.DecodeString(auth[len("CredSSP "):])
+		s.c.Assert(err, gc.IsNil)
+		if conn == nil || conn.authenticated {
+			conn = s.accept()
+			s.conns[r.RemoteAddr] = conn
+		}
+		if conn.handshake != nil {
+			s.reply(w, s.handshakeStep(conn, token))
+			return
+		}
+		msg, err := conn.session.receive(token)
+		s.c.Assert(err, gc.IsNil)
+		req := &tsRequest{}
+		_, err = asn1.Unmarshal(msg, req)
+		s.c.Assert(err, gc.IsNil)
+		s.c.Assert(req.Version, gc.Equals, credsspVersion)
+		if req.AuthInfo != nil {
+			s.delegate(conn, req)
+			if r.TLS == nil {
+				s.c.Assert(body, gc.HasLen, 0)
+			}
+			w.Write(body)
+			return
+		}
+		s.reply(w, s.seal(conn, s.authenticate(conn, req)))
+	default:
+		w.Header().Add("WWW-Authenticate", "CredSSP")
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// accept starts the TLS handshake of a new connection
+func (s *credsspServer) accept() *credsspConn {
+	tunnel := &tlsTunnel{flush: make(chan []byte), feed: make(chan []byte)}
+	conn := &credsspConn{
+		session: &credsspSession{
+			tunnel: tunnel,
+			conn:   tls.Server(tunnel, &tls.Config{Certificates: []tls.Certificate{s.cert}}),
+		},
+		handshake: make(chan error, 1),
+	}
+	go func() { conn.handshake <- conn.session.conn.Handshake() }()
+	// the handshake waits for the ClientHello
+	<-tunnel.flush
+	return conn
+}
+
+// handshakeStep feeds the records of the client to the TLS handshake and
+// returns those of the server
+func (s *credsspServer) handshakeStep(conn *credsspConn, records []byte) []byte {
+	tunnel := conn.session.tunnel
+	tunnel.feed <- records
+	select {
+	case reply := <-tunnel.flush:
+		return reply
+	case err := <-conn.handshake:
+		s.c.Assert(err, gc.IsNil)
+		conn.handshake, tunnel.flush, tunnel.feed = nil, nil, nil
+		return tunnel.take()
+	}
+}
+
+// authenticate answers the NTLM messages of the client and checks the
+// public key binding sent along with its AUTHENTICATE_MESSAGE
+func (s *credsspServer) authenticate(conn *credsspConn, req *tsRequest) *tsRequest {
+	s.c.Assert(req.NegoTokens, gc.HasLen, 1)
+	token := req.NegoTokens[0].Token
+	if binary.LittleEndian.Uint32(token[8:]) == 1 {
+		challenge, _ := base64.StdEncoding.DecodeString(recordedChallenge)
+		return &tsRequest{Version: s.version, NegoTokens: []negoToken{{challenge}}}
+	}
+
+	conn.ntlm = (&ntlmServer{password: s.password}).verify(token)
+	if conn.ntlm == nil {
+		return &tsRequest{Version: s.version, ErrorCode: statusLogonFailure}
+	}
+	pubKey, err := subjectPublicKey(s.publicKeyInfo())
+	s.c.Assert(err, gc.IsNil)
+	binding, err := conn.ntlm.Unwrap(req.PubKeyAuth[:16], req.PubKeyAuth[16:])
+	s.c.Assert(err, gc.IsNil)
+	serverBinding := append([]byte{pubKey[0] + 1}, pubKey[1:]...)
+	if s.version >= 5 {
+		s.c.Assert(req.ClientNonce, gc.HasLen, 32)
+		s.c.Assert(binding, gc.DeepEquals, credsspBinding("CredSSP Client-To-Server Binding Hash\x00", req.ClientNonce, pubKey))
+		serverBinding = credsspBinding("CredSSP Server-To-Client Binding Hash\x00", req.ClientNonce, pubKey)
+	} else {
+		s.c.Assert(req.ClientNonce, gc.HasLen, 0)
+		s.c.Assert(binding, gc.DeepEquals, pubKey)
+	}
+	if s.badBinding {
+		serverBinding[0]++
+	}
+	signature, sealed, err := conn.ntlm.Wrap(serverBinding)
+	s.c.Assert(err, gc.IsNil)
+	return &tsRequest{Version: s.version, PubKeyAuth: append(signature, sealed...)}
+}
+
+// delegate records the credentials of the final TSRequest
+func (s *credsspServer) delegate(conn *credsspConn, req *tsRequest) {
+	msg, err := conn.ntlm.Unwrap(req.AuthInfo[:16], req.AuthInfo[16:])
+	s.c.Assert(err, gc.IsNil)
+	var creds tsCredentials
+	_, err = asn1.Unmarshal(msg, &creds)
+	s.c.Assert(err, gc.IsNil)
+	s.c.Assert(creds.CredType, gc.Equals, 1)
+	var password tsPasswordCreds
+	_, err = asn1.Unmarshal(creds.Credentials, &password)
+	s.c.Assert(err, gc.IsNil)
+	s.delegated = append(s.delegated, string(utf16Decode(password.DomainName))+`\`+
+		string(utf16Decode(password.UserName))+":"+string(utf16Decode(password.Password)))
+	s.handshakes++
+	conn.authenticated = true
+}
+
+func (s *credsspServer) publicKeyInfo() []byte {
+	cert, err := x509.ParseCertificate(s.cert.Certificate[0])
+	s.c.Assert(err, gc.IsNil)
+	return cert.RawSubjectPublicKeyInfo
+}
+
+// seal returns the records carrying req to the client
+func (s *credsspServer) seal(conn *credsspConn, req *tsRequest) []byte {
+	msg, err := asn1.Marshal(*req)
+	s.c.Assert(err, gc.IsNil)
+	records, err := conn.session.send(msg)
+	s.c.Assert(err, gc.IsNil)
+	return records
+}
+
+// reply sends records to the client, expecting more from it
+func (s *credsspServer) reply(w http.ResponseWriter, records []byte) {
+	w.Header().Set("WWW-Authenticate", "CredSSP "+base64.StdEncoding.EncodeToString(records))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (CredSSPSuite) TestHttpCredSSPAuthEncrypted(c *gc.C) {
+	server := newCredSSPServer(c, "Passw0rd", false)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "CredSSPAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "Passw0rd",
+	}
+	// large messages are sealed in several TLS records
+	large := strings.Repeat("trololol", 5000)
+	for _, msg := range []string{"trololol", large, "trololol"} {
+		resp, err := req.HttpCredSSPAuth([]byte(msg))
+		c.Assert(err, gc.IsNil)
+		c.Assert(resp.StatusCode, gc.Equals, 200)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, msg)
+	}
+	c.Assert(server.handshakes, gc.Equals, 1)
+	c.Assert(server.delegated, gc.DeepEquals, []string{`WINHOST\Administrator:Passw0rd`})
+	c.Assert(server.raw, gc.HasLen, 3)
+	for _, raw := range server.raw {
+		c.Assert(strings.Contains(raw, "trololol"), gc.Equals, false)
+	}
+	c.Assert(strings.Count(server.raw[1], "OriginalContent"), gc.Equals, 3)
+}
+
+func (CredSSPSuite) TestHttpCredSSPAuth(c *gc.C) {
+	server := newCredSSPServer(c, "Passw0rd", true)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint:     server.URL,
+		AuthType:     "CredSSPAuth",
+		Username:     "Administrator",
+		Passwd:       "Passw0rd",
+		HttpInsecure: true,
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := req.HttpCredSSPAuth([]byte("trololol"))
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, "trololol")
+	}
+	c.Assert(server.handshakes, gc.Equals, 1)
+	c.Assert(server.delegated, gc.DeepEquals, []string{`\Administrator:Passw0rd`})
+	c.Assert(server.raw, gc.DeepEquals, []string{"trololol", "trololol"})
+}
+
+func (CredSSPSuite) TestHttpCredSSPAuthLegacyVersion(c *gc.C) {
+	server := newCredSSPServer(c, "Passw0rd", false)
+	defer server.Close()
+	server.version = 3
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "CredSSPAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "Passw0rd",
+	}
+	resp, err := req.HttpCredSSPAuth([]byte("trololol"))
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(body), gc.Equals, "trololol")
+	c.Assert(server.delegated, gc.HasLen, 1)
+}
+
+func (CredSSPSuite) TestHttpCredSSPAuthBindingMismatch(c *gc.C) {
+	server := newCredSSPServer(c, "Passw0rd", false)
+	defer server.Close()
+	server.badBinding = true
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "CredSSPAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "Passw0rd",
+	}
+	resp, err := req.HttpCredSSPAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "CredSSP server public key binding mismatch")
+	// the credentials are not delegated to an unauthenticated server
+	c.Assert(server.delegated, gc.HasLen, 0)
+}
+
+func (CredSSPSuite) TestHttpCredSSPAuthWrongPassword(c *gc.C) {
+	server := newCredSSPServer(c, "Passw0rd", false)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "CredSSPAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "wrong",
+	}
+	resp, err := req.HttpCredSSPAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "CredSSP authentication failed with error code 0xc000006d")
+}
+
+func (CredSSPSuite) TestHttpCredSSPAuthNoToken(c *gc.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "CredSSPAuth",
+		Username: "Administrator",
+		Passwd:   "Passw0rd",
+	}
+	resp, err := req.HttpCredSSPAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "CredSSP handshake failed: remote host returned status code 401 without a token")
+}
+
+func (CredSSPSuite) TestSendMessageCredSSPAuthNeedsCredentials(c *gc.C) {
+	req := SoapRequest{AuthType: "CredSSPAuth", Username: "Administrator"}
+
+	resp, err := req.SendMessage(&Envelope{})
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "AuthType CredSSPAuth needs Username and Passwd")
+}
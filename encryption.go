@@ -0,0 +1,133 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Protocols of the multipart/encrypted bodies exchanged once a security
+// context seals the SOAP messages
+const (
+	spnegoEncryptedProtocol   = "application/HTTP-SPNEGO-session-encrypted"
+	kerberosEncryptedProtocol = "application/HTTP-Kerberos-session-encrypted"
+	credsspEncryptedProtocol  = "application/HTTP-CredSSP-session-encrypted"
+)
+
+const encryptedBoundary = "Encrypted Boundary"
+
+// sessionSealer is a security context able to seal and unseal messages,
+// such as an authenticated NTLM or Kerberos session
+type sessionSealer interface {
+	// Wrap returns the signature and the encrypted form of msg
+	Wrap(msg []byte) ([]byte, []byte, error)
+	// Unwrap checks signature and returns the decrypted message
+	Unwrap(signature, sealed []byte) ([]byte, error)
+}
+
+// encryptedChunkSize returns the largest part of a message sealed at once
+// for protocol, or 0 if messages are sealed whole. CredSSP seals at most
+// one TLS record per part.
+func encryptedChunkSize(protocol string) int {
+	if protocol == credsspEncryptedProtocol {
+		return 16384
+	}
+	return 0
+}
+
+// encryptedContentType returns the Content-Type of a message of length
+// bytes encrypted for protocol. Messages sealed in several parts are
+// multipart/x-multi-encrypted.
+func encryptedContentType(protocol string, length int) string {
+	kind := "multipart/encrypted"
+	if size := encryptedChunkSize(protocol); size > 0 && length > size {
+		kind = "multipart/x-multi-encrypted"
+	}
+	return fmt.Sprintf("%s;protocol=%q;boundary=%q", kind, protocol, encryptedBoundary)
+}
+
+// encryptMessage seals a SOAP message into a multipart/encrypted body
+func encryptMessage(sealer sessionSealer, protocol string, msg []byte) ([]byte, error) {
+	size := encryptedChunkSize(protocol)
+	if size == 0 {
+		size = len(msg)
+	}
+	var body bytes.Buffer
+	for i := 0; i == 0 || i < len(msg); i += size {
+		chunk := msg[i:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		signature, sealed, err := sealer.Wrap(chunk)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&body, "--%s\r\n", encryptedBoundary)
+		fmt.Fprintf(&body, "\tContent-Type: %s\r\n", protocol)
+		fmt.Fprintf(&body, "\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=%d\r\n", len(chunk))
+		fmt.Fprintf(&body, "--%s\r\n", encryptedBoundary)
+		fmt.Fprint(&body, "\tContent-Type: application/octet-stream\r\n")
+		binary.Write(&body, binary.LittleEndian, uint32(len(signature)))
+		body.Write(signature)
+		body.Write(sealed)
+	}
+	fmt.Fprintf(&body, "--%s--\r\n", encryptedBoundary)
+	return body.Bytes(), nil
+}
+
+var originalLength = regexp.MustCompile(`Length=(\d+)`)
+
+// decryptMessage unseals a multipart/encrypted body back into the SOAP
+// message it carries
+func decryptMessage(sealer sessionSealer, body []byte) ([]byte, error) {
+	body = bytes.TrimSuffix(body, []byte("--"+encryptedBoundary+"--\r\n"))
+	parts := bytes.Split(body, []byte("--"+encryptedBoundary+"\r\n"))
+	if len(parts) < 3 || len(parts)%2 != 1 || len(parts[0]) != 0 {
+		return nil, errors.New("Invalid encrypted message")
+	}
+	var msg []byte
+	for i := 1; i < len(parts); i += 2 {
+		chunk, err := decryptPart(sealer, parts[i], parts[i+1])
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+	return msg, nil
+}
+
+// decryptPart unseals the data of one part, described by header
+func decryptPart(sealer sessionSealer, header, data []byte) ([]byte, error) {
+	match := originalLength.FindSubmatch(header)
+	if match == nil {
+		return nil, errors.New("Invalid encrypted message")
+	}
+	length, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		return nil, errors.New("Invalid encrypted message")
+	}
+
+	dataHeader := []byte("\tContent-Type: application/octet-stream\r\n")
+	if !bytes.HasPrefix(data, dataHeader) {
+		return nil, errors.New("Invalid encrypted message")
+	}
+	data = data[len(dataHeader):]
+	if len(data) < 4 {
+		return nil, errors.New("Invalid encrypted message")
+	}
+	sigLength := int(binary.LittleEndian.Uint32(data))
+	if 4+sigLength > len(data) {
+		return nil, errors.New("Invalid encrypted message")
+	}
+	msg, err := sealer.Unwrap(data[4:4+sigLength], data[4+sigLength:])
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) != length {
+		return nil, errors.New("Invalid encrypted message length")
+	}
+	return msg, nil
+}
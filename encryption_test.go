@@ -0,0 +1,71 @@
+package winrm
+
+import (
+	"bytes"
+
+	gc "launchpad.net/gocheck"
+)
+
+type EncryptionSuite struct{}
+
+var _ = gc.Suite(EncryptionSuite{})
+
+// nullSealer leaves messages in clear, with a fixed signature
+type nullSealer struct{}
+
+func (nullSealer) Wrap(msg []byte) ([]byte, []byte, error) {
+	return []byte("signature"), msg, nil
+}
+
+func (nullSealer) Unwrap(signature, sealed []byte) ([]byte, error) {
+	return sealed, nil
+}
+
+func (EncryptionSuite) TestEncryptedContentType(c *gc.C) {
+	c.Assert(encryptedContentType(spnegoEncryptedProtocol, 20000), gc.Equals, `multipart/encrypted;protocol="application/HTTP-SPNEGO-session-encrypted";boundary="Encrypted Boundary"`)
+	c.Assert(encryptedContentType(credsspEncryptedProtocol, 16384), gc.Equals, `multipart/encrypted;protocol="application/HTTP-CredSSP-session-encrypted";boundary="Encrypted Boundary"`)
+	c.Assert(encryptedContentType(credsspEncryptedProtocol, 16385), gc.Equals, `multipart/x-multi-encrypted;protocol="application/HTTP-CredSSP-session-encrypted";boundary="Encrypted Boundary"`)
+}
+
+func (EncryptionSuite) TestEncryptMessage(c *gc.C) {
+	body, err := encryptMessage(nullSealer{}, spnegoEncryptedProtocol, []byte("<s:Envelope/>"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(body), gc.Equals, "--Encrypted Boundary\r\n"+
+		"\tContent-Type: application/HTTP-SPNEGO-session-encrypted\r\n"+
+		"\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=13\r\n"+
+		"--Encrypted Boundary\r\n"+
+		"\tContent-Type: application/octet-stream\r\n"+
+		"\x09\x00\x00\x00signature<s:Envelope/>--Encrypted Boundary--\r\n")
+
+	msg, err := decryptMessage(nullSealer{}, body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(msg), gc.Equals, "<s:Envelope/>")
+}
+
+func (EncryptionSuite) TestEncryptMessageChunks(c *gc.C) {
+	msg := bytes.Repeat([]byte("x"), 40000)
+	body, err := encryptMessage(nullSealer{}, credsspEncryptedProtocol, msg)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Count(body, []byte("Length=16384\r\n")), gc.Equals, 2)
+	c.Assert(bytes.Count(body, []byte("Length=7232\r\n")), gc.Equals, 1)
+
+	plain, err := decryptMessage(nullSealer{}, body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(plain, gc.DeepEquals, msg)
+}
+
+func (EncryptionSuite) TestDecryptMessageInvalid(c *gc.C) {
+	body, err := encryptMessage(nullSealer{}, spnegoEncryptedProtocol, []byte("<s:Envelope/>"))
+	c.Assert(err, gc.IsNil)
+
+	for _, invalid := range [][]byte{
+		[]byte("<s:Envelope/>"),
+		bytes.Replace(body, []byte("Length=13"), []byte("Length=12"), 1),
+		bytes.Replace(body, []byte("Length=13"), []byte("Size=13"), 1),
+		bytes.Replace(body, []byte("\x09\x00\x00\x00"), []byte("\xff\x00\x00\x00"), 1),
+		bytes.Replace(body, []byte("application/octet-stream"), []byte("text/plain"), 1),
+	} {
+		_, err := decryptMessage(nullSealer{}, invalid)
+		c.Assert(err, gc.ErrorMatches, "Invalid encrypted message.*")
+	}
+}
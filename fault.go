@@ -0,0 +1,123 @@
+package winrm
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Errors matched by the WSManFault of common failures, to be tested with
+// errors.Is
+var (
+	// ErrOperationTimeout is matched by a w:TimedOut fault, which a
+	// Receive gets when the command produced no output within
+	// OperationTimeout
+	ErrOperationTimeout = errors.New("WS-Management operation timed out")
+	// ErrShellNotFound is matched when the shell of a request does not
+	// exist on the server, for example after it was idle for too long
+	ErrShellNotFound = errors.New("WS-Management shell not found")
+	// ErrQuotaExceeded is matched when the user reached a quota such as
+	// the maximum number of shells
+	ErrQuotaExceeded = errors.New("WS-Management quota exceeded")
+	// ErrAccessDenied is matched when the user is not allowed to run the
+	// operation
+	ErrAccessDenied = errors.New("WS-Management access denied")
+)
+
+// Numeric codes of the WSManFault detail
+const (
+	wsmanAccessDenied     = 5
+	wsmanOperationTimeout = 2150858793
+	wsmanShellNotFound    = 2150858843
+	wsmanQuotaMaxShells   = 2150859173
+)
+
+// WSManFault is the error returned when the endpoint answers with a SOAP
+// fault
+type WSManFault struct {
+	// Code and Subcode are the SOAP fault codes, such as s:Receiver
+	// and w:TimedOut
+	Code    string
+	Subcode string
+	// WSManCode is the numeric code of the WSManFault detail, usually
+	// a Windows error code
+	WSManCode uint32
+	Machine   string
+	Message   string
+}
+
+func (fault *WSManFault) Error() string {
+	msg := "WS-Management fault"
+	if fault.Subcode != "" {
+		msg += " " + fault.Subcode
+	} else if fault.Code != "" {
+		msg += " " + fault.Code
+	}
+	if fault.WSManCode != 0 {
+		msg += fmt.Sprintf(" (code %d)", fault.WSManCode)
+	}
+	if fault.Machine != "" {
+		msg += " on " + fault.Machine
+	}
+	if fault.Message != "" {
+		msg += ": " + fault.Message
+	}
+	return msg
+}
+
+// Is reports whether fault is one of the common failures of the Err
+// variables
+func (fault *WSManFault) Is(target error) bool {
+	switch target {
+	case ErrOperationTimeout:
+		return fault.hasSubcode("TimedOut") || fault.WSManCode == wsmanOperationTimeout
+	case ErrShellNotFound:
+		return fault.WSManCode == wsmanShellNotFound
+	case ErrQuotaExceeded:
+		return fault.hasSubcode("QuotaLimit") || fault.WSManCode == wsmanQuotaMaxShells
+	case ErrAccessDenied:
+		return fault.hasSubcode("AccessDenied") || fault.WSManCode == wsmanAccessDenied
+	}
+	return false
+}
+
+// hasSubcode reports whether the subcode of fault is name, whatever its
+// namespace prefix
+func (fault *WSManFault) hasSubcode(name string) bool {
+	return fault.Subcode == name || strings.HasSuffix(fault.Subcode, ":"+name)
+}
+
+// parseFault returns the fault carried by body, or nil if body is not a
+// SOAP fault
+func parseFault(body []byte) *WSManFault {
+	var response ResponseEnvelope
+	if err := xml.Unmarshal(body, &response); err != nil || response.Body == nil || response.Body.Fault == nil {
+		return nil
+	}
+	fault := response.Body.Fault
+	if fault.Code == nil || fault.Code.Value == "" {
+		return nil
+	}
+	result := &WSManFault{Code: strings.TrimSpace(fault.Code.Value)}
+	if fault.Code.Subcode != nil {
+		result.Subcode = strings.TrimSpace(fault.Code.Subcode.Value)
+	}
+	if fault.Detail != nil && fault.Detail.WSManFault != nil {
+		detail := fault.Detail.WSManFault
+		code, _ := strconv.ParseUint(detail.Code, 10, 32)
+		result.WSManCode = uint32(code)
+		result.Machine = detail.Machine
+		if detail.Message != nil {
+			result.Message = strings.TrimSpace(detail.Message.Text)
+			if result.Message == "" {
+				result.Message = strings.TrimSpace(detail.Message.ProviderFault)
+			}
+		}
+	}
+	if result.Message == "" && fault.Reason != nil {
+		result.Message = strings.TrimSpace(fault.Reason.Text)
+	}
+	return result
+}
@@ -0,0 +1,80 @@
+package winrm
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	gc "launchpad.net/gocheck"
+)
+
+type FaultSuite struct{}
+
+var _ = gc.Suite(FaultSuite{})
+
+func faultEnvelope(fault string) string {
+	return `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"><s:Header/><s:Body>` + fault + `</s:Body></s:Envelope>`
+}
+
+const shellNotFoundFault = `<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>w:InvalidSelectors</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en-US">The WS-Management service cannot process the request because the request contained invalid selectors for the resource. </s:Text></s:Reason><s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150858843" Machine="windows-host"><f:Message>The request for the Windows Remote Shell with ShellId 11A3D7D4-3C61-4E59-B94A-A4C3A4C72C1F failed because the shell was not found on the server. Possible causes are: the specified ShellId is incorrect or the shell no longer exists on the server. Provide the correct ShellId or create a new shell and retry the operation. </f:Message></f:WSManFault></s:Detail></s:Fault>`
+
+const quotaFault = `<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>w:QuotaLimit</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en-US">The WS-Management service cannot process the request. This user is allowed a maximum number of 5 concurrent shells, which has been exceeded. Close existing shells or raise the quota for this user. </s:Text></s:Reason><s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150859173" Machine="windows-host"><f:Message><f:ProviderFault provider="Shell cmd plugin" path="%systemroot%\system32\winrscmd.dll">The WS-Management service cannot process the request. This user is allowed a maximum number of 5 concurrent shells, which has been exceeded. Close existing shells or raise the quota for this user. </f:ProviderFault></f:Message></f:WSManFault></s:Detail></s:Fault>`
+
+const accessDeniedFault = `<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>w:AccessDenied</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en-US">Access is denied. </s:Text></s:Reason><s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="5" Machine="windows-host"><f:Message>Access is denied. </f:Message></f:WSManFault></s:Detail></s:Fault>`
+
+func (FaultSuite) TestParseFault(c *gc.C) {
+	fault := parseFault([]byte(faultEnvelope(timedOutFault)))
+	c.Assert(fault, gc.DeepEquals, &WSManFault{
+		Code:      "s:Receiver",
+		Subcode:   "w:TimedOut",
+		WSManCode: 2150858793,
+		Machine:   "windows-host",
+		Message:   "The WS-Management service cannot complete the operation within the time specified in OperationTimeout.",
+	})
+	c.Assert(fault, gc.ErrorMatches, `WS-Management fault w:TimedOut \(code 2150858793\) on windows-host: The WS-Management service cannot complete the operation within the time specified in OperationTimeout\.`)
+
+	// provider faults nest the message
+	fault = parseFault([]byte(faultEnvelope(quotaFault)))
+	c.Assert(fault.Message, gc.Matches, "The WS-Management service cannot process the request. This user is allowed a maximum number of 5 concurrent shells.*")
+
+	// the reason stands for a missing WSManFault detail
+	fault = parseFault([]byte(faultEnvelope(`<s:Fault><s:Code><s:Value>s:Sender</s:Value></s:Code><s:Reason><s:Text xml:lang="en-US">Bad request</s:Text></s:Reason></s:Fault>`)))
+	c.Assert(fault, gc.DeepEquals, &WSManFault{Code: "s:Sender", Message: "Bad request"})
+	c.Assert(fault, gc.ErrorMatches, "WS-Management fault s:Sender: Bad request")
+
+	c.Assert(parseFault([]byte(faultEnvelope(`<rsp:ReceiveResponse/>`))), gc.IsNil)
+	c.Assert(parseFault([]byte("junk")), gc.IsNil)
+}
+
+func (FaultSuite) TestFaultIs(c *gc.C) {
+	sentinels := []error{ErrOperationTimeout, ErrShellNotFound, ErrQuotaExceeded, ErrAccessDenied}
+	for i, body := range []string{timedOutFault, shellNotFoundFault, quotaFault, accessDeniedFault} {
+		var err error = parseFault([]byte(faultEnvelope(body)))
+		for j, sentinel := range sentinels {
+			c.Assert(errors.Is(err, sentinel), gc.Equals, i == j, gc.Commentf("fault %d, sentinel %v", i, sentinel))
+		}
+	}
+
+	// a bare subcode is enough
+	var err error = &WSManFault{Code: "s:Receiver", Subcode: "w:TimedOut"}
+	c.Assert(errors.Is(err, ErrOperationTimeout), gc.Equals, true)
+	err = &WSManFault{Code: "s:Sender", Subcode: "w:InvalidSelectors"}
+	c.Assert(errors.Is(err, ErrShellNotFound), gc.Equals, false)
+}
+
+func (FaultSuite) TestStatusErrorFault(c *gc.C) {
+	resp := &http.Response{
+		StatusCode: 500,
+		Body:       ioutil.NopCloser(strings.NewReader(faultEnvelope(accessDeniedFault))),
+	}
+	err := statusError(resp)
+	c.Assert(errors.Is(err, ErrAccessDenied), gc.Equals, true)
+	fault, ok := err.(*WSManFault)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(fault.Machine, gc.Equals, "windows-host")
+	c.Assert(fault.WSManCode, gc.Equals, uint32(5))
+
+	resp = &http.Response{StatusCode: 500, Body: ioutil.NopCloser(strings.NewReader("fail"))}
+	c.Assert(statusError(resp), gc.ErrorMatches, "Remote host returned error status code: 500")
+}
@@ -0,0 +1,364 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/etype"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// defaultKrb5Conf is read when KerberosCredentials.Krb5Conf is empty
+const defaultKrb5Conf = "/etc/krb5.conf"
+
+// kerberosContextFlags are the GSS-API services requested from the server
+const kerberosContextFlags = gssapi.ContextFlagMutual | gssapi.ContextFlagSequence |
+	gssapi.ContextFlagConf | gssapi.ContextFlagInteg
+
+// Flags of the wrap tokens, see RFC 4121 4.2.2
+const (
+	gssSentByAcceptor = 0x01
+	gssSealed         = 0x02
+	gssAcceptorSubkey = 0x04
+)
+
+// KerberosCredentials describes where KerberosAuth finds its Kerberos
+// configuration and the secret of Username. When neither Keytab nor
+// CCache is set, Passwd is used.
+type KerberosCredentials struct {
+	// Krb5Conf is the path of the krb5.conf describing the realms,
+	// /etc/krb5.conf when empty
+	Krb5Conf string
+	// Keytab is the path of a keytab holding the keys of Username
+	Keytab string
+	// CCache is the path of a credential cache holding a TGT, such as the
+	// one filled by kinit. Username is then taken from the cache.
+	CCache string
+	// SPN overrides the service principal HTTP/<host> derived from the
+	// endpoint, for hosts reached through a CNAME or an IP address
+	SPN string
+}
+
+// kerberosLogin holds the Kerberos client shared by the connections of a
+// SoapRequest, so that its TGT and service tickets are reused
+type kerberosLogin struct {
+	mu     sync.Mutex
+	client *client.Client
+}
+
+// get returns the Kerberos client of conf, logging in on first use
+func (login *kerberosLogin) get(conf *SoapRequest) (*client.Client, error) {
+	login.mu.Lock()
+	defer login.mu.Unlock()
+	if login.client == nil {
+		cl, err := newKerberosClient(conf.Username, conf.Passwd, conf.kerberosCredentials())
+		if err != nil {
+			return nil, err
+		}
+		login.client = cl
+	}
+	return login.client, nil
+}
+
+// newKerberosClient obtains a TGT for username from creds
+func newKerberosClient(username, passwd string, creds *KerberosCredentials) (*client.Client, error) {
+	path := creds.Krb5Conf
+	if path == "" {
+		path = defaultKrb5Conf
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		if _, ok := err.(config.UnsupportedDirective); !ok {
+			return nil, errors.New(fmt.Sprintf("Cannot load Kerberos configuration: %v", err))
+		}
+	}
+
+	if creds.CCache != "" {
+		ccache, err := credentials.LoadCCache(creds.CCache)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot load Kerberos credential cache %s: %v", creds.CCache, err))
+		}
+		return client.NewFromCCache(ccache, cfg, client.DisablePAFXFAST(true))
+	}
+
+	user, realm := kerberosPrincipal(username, cfg.LibDefaults.DefaultRealm)
+	if user == "" {
+		return nil, errors.New("AuthType KerberosAuth needs Username")
+	}
+	var cl *client.Client
+	if creds.Keytab != "" {
+		kt, err := keytab.Load(creds.Keytab)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot load Kerberos keytab %s: %v", creds.Keytab, err))
+		}
+		cl = client.NewWithKeytab(user, realm, kt, cfg, client.DisablePAFXFAST(true))
+	} else if passwd != "" {
+		cl = client.NewWithPassword(user, realm, passwd, cfg, client.DisablePAFXFAST(true))
+	} else {
+		return nil, errors.New("AuthType KerberosAuth needs a Keytab, a CCache or Passwd")
+	}
+	if err := cl.Login(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// kerberosPrincipal splits user@REALM, falling back to defaultRealm
+func kerberosPrincipal(username, defaultRealm string) (string, string) {
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		return username[:i], strings.ToUpper(username[i+1:])
+	}
+	return username, defaultRealm
+}
+
+// kerberosSPN returns the service principal the endpoint authenticates as
+func kerberosSPN(endpoint string, creds *KerberosCredentials) (string, error) {
+	if creds.SPN != "" {
+		return creds.SPN, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return "HTTP/" + u.Hostname(), nil
+}
+
+// kerberosSession is the security context established with the server
+type kerberosSession struct {
+	// ticketKey is the session key of the service ticket
+	ticketKey types.EncryptionKey
+	// key protects the messages: the acceptor subkey if the server sent
+	// one, else the initiator subkey
+	key            types.EncryptionKey
+	acceptorSubkey bool
+	// acceptor is set on the server side of the context
+	acceptor bool
+	// ctime and cusec identify the authenticator echoed by the server
+	ctime time.Time
+	cusec int
+	// sendSeq and recvSeq are the initial sequence numbers of each side
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// kerberosInitiate builds the SPNEGO token carrying an AP-REQ for spn,
+// asking the server for mutual authentication
+func kerberosInitiate(cl *client.Client, spn string) ([]byte, *kerberosSession, error) {
+	tkt, key, err := cl.GetServiceTicket(spn)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := types.NewAuthenticator(cl.Credentials.Domain(), cl.Credentials.CName())
+	if err != nil {
+		return nil, nil, err
+	}
+	etype, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := auth.GenerateSeqNumberAndSubKey(key.KeyType, etype.GetKeyByteSize()); err != nil {
+		return nil, nil, err
+	}
+	// RFC 4121 4.1.1: the checksum carries the requested context flags
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum, 16)
+	binary.LittleEndian.PutUint32(checksum[20:], kerberosContextFlags)
+	auth.Cksum = types.Checksum{CksumType: chksumtype.GSSAPI, Checksum: checksum}
+
+	apReq, err := messages.NewAPReq(tkt, key, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
+	b, err := apReq.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	mechToken, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, nil, err
+	}
+	mechToken = append(mechToken, 0x01, 0x00)
+	mechToken = asn1tools.AddASNAppTag(append(mechToken, b...), 0)
+
+	token := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mechToken,
+		},
+	}
+	msg, err := token.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	session := &kerberosSession{
+		ticketKey: key,
+		key:       auth.SubKey,
+		ctime:     auth.CTime,
+		cusec:     auth.Cusec,
+		sendSeq:   uint64(auth.SeqNumber),
+	}
+	return msg, session, nil
+}
+
+// accept checks the AP-REP the server returned in token, proving it owns
+// the key of the service ticket
+func (session *kerberosSession) accept(token []byte) error {
+	if token == nil {
+		return errors.New("Kerberos mutual authentication failed: no response token")
+	}
+	_, negToken, err := spnego.UnmarshalNegToken(token)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Kerberos mutual authentication failed: %v", err))
+	}
+	resp, ok := negToken.(spnego.NegTokenResp)
+	if !ok || resp.State() != spnego.NegStateAcceptCompleted {
+		return errors.New("Kerberos mutual authentication failed: context not accepted")
+	}
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(resp.ResponseToken); err != nil || !krb5Token.IsAPRep() {
+		return errors.New("Kerberos mutual authentication failed: no AP-REP")
+	}
+	b, err := crypto.DecryptEncPart(krb5Token.APRep.EncPart, session.ticketKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Kerberos mutual authentication failed: %v", err))
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(b); err != nil {
+		return errors.New(fmt.Sprintf("Kerberos mutual authentication failed: %v", err))
+	}
+	// the ctime travels with a precision of one second
+	if part.CTime.Unix() != session.ctime.Unix() || part.Cusec != session.cusec {
+		return errors.New("Kerberos mutual authentication failed: authenticator mismatch")
+	}
+	if part.Subkey.KeyType != 0 {
+		session.key = part.Subkey
+		session.acceptorSubkey = true
+	}
+	session.recvSeq = uint64(part.SequenceNumber)
+	return nil
+}
+
+// wrapHeader builds the header of a wrap token, RFC 4121 4.2.6.2
+func wrapHeader(flags byte, ec, rrc uint16, seq uint64) []byte {
+	header := []byte{0x05, 0x04, flags, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[4:], ec)
+	binary.BigEndian.PutUint16(header[6:], rrc)
+	binary.BigEndian.PutUint64(header[8:], seq)
+	return header
+}
+
+// sealUsages returns the key usages of the messages sent and received by
+// this side of the context
+func (session *kerberosSession) sealUsages() (uint32, uint32) {
+	if session.acceptor {
+		return keyusage.GSSAPI_ACCEPTOR_SEAL, keyusage.GSSAPI_INITIATOR_SEAL
+	}
+	return keyusage.GSSAPI_INITIATOR_SEAL, keyusage.GSSAPI_ACCEPTOR_SEAL
+}
+
+func (session *kerberosSession) etype() (etype.EType, error) {
+	switch session.key.KeyType {
+	case etypeID.RC4_HMAC, etypeID.RC4_HMAC_EXP:
+		return nil, errors.New(fmt.Sprintf("Kerberos message encryption does not support encryption type %d", session.key.KeyType))
+	}
+	return crypto.GetEtype(session.key.KeyType)
+}
+
+// Wrap seals msg into a wrap token, as GSS_Wrap with confidentiality. Like
+// Windows, the encrypted header and the checksum are rotated in front of
+// the sealed data, so that the latter keeps the length of msg.
+func (session *kerberosSession) Wrap(msg []byte) ([]byte, []byte, error) {
+	et, err := session.etype()
+	if err != nil {
+		return nil, nil, err
+	}
+	flags := byte(gssSealed)
+	if session.acceptor {
+		flags |= gssSentByAcceptor
+	}
+	if session.acceptorSubkey {
+		flags |= gssAcceptorSubkey
+	}
+	seq := session.sendSeq
+	usage, _ := session.sealUsages()
+
+	plain := append(append([]byte{}, msg...), wrapHeader(flags, 0, 0, seq)...)
+	_, encrypted, err := et.EncryptMessage(session.key.KeyValue, plain, usage)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.sendSeq++
+
+	rrc := 16 + et.GetHMACBitLength()/8
+	n := len(encrypted) - rrc
+	token := wrapHeader(flags, 0, uint16(rrc), seq)
+	token = append(token, encrypted[n:]...)
+	token = append(token, encrypted[:n]...)
+	split := len(token) - len(msg)
+	return token[:split], token[split:], nil
+}
+
+// Unwrap checks and decrypts the wrap token made of signature and sealed
+func (session *kerberosSession) Unwrap(signature, sealed []byte) ([]byte, error) {
+	et, err := session.etype()
+	if err != nil {
+		return nil, err
+	}
+	token := append(append([]byte{}, signature...), sealed...)
+	if len(token) < 16 || token[0] != 0x05 || token[1] != 0x04 || token[3] != 0xff {
+		return nil, errors.New("Invalid Kerberos wrap token")
+	}
+	flags := token[2]
+	if flags&gssSealed == 0 || (flags&gssSentByAcceptor != 0) == session.acceptor {
+		return nil, errors.New("Invalid Kerberos wrap token")
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+	seq := binary.BigEndian.Uint64(token[8:])
+
+	data := token[16:]
+	if len(data) < et.GetConfounderByteSize()+16+et.GetHMACBitLength()/8 || rrc > len(data) {
+		return nil, errors.New("Invalid Kerberos wrap token")
+	}
+	data = append(append([]byte{}, data[rrc:]...), data[:rrc]...)
+	_, usage := session.sealUsages()
+	plain, err := et.DecryptMessage(session.key.KeyValue, data, usage)
+	if err != nil {
+		return nil, errors.New("Invalid Kerberos wrap token signature")
+	}
+	if len(plain) < ec+16 {
+		return nil, errors.New("Invalid Kerberos wrap token")
+	}
+	// the encrypted copy of the header carries no rotation count
+	header := plain[len(plain)-16:]
+	if !bytes.Equal(header[:6], token[:6]) || !bytes.Equal(header[8:], token[8:16]) {
+		return nil, errors.New("Invalid Kerberos wrap token")
+	}
+	if seq != session.recvSeq {
+		return nil, errors.New("Invalid Kerberos wrap token sequence number")
+	}
+	session.recvSeq++
+	return plain[:len(plain)-ec-16], nil
+}
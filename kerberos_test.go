@@ -0,0 +1,613 @@
+package winrm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	gc "launchpad.net/gocheck"
+)
+
+type KerberosSuite struct{}
+
+var _ = gc.Suite(KerberosSuite{})
+
+const (
+	testRealm    = "EXAMPLE.COM"
+	testSPN      = "HTTP/winrm.example.com"
+	testUser     = "alice"
+	testPassword = "Passw0rd"
+)
+
+// kdcStandIn is an in-process KDC of testRealm. It answers AS and TGS
+// exchanges over TCP, issuing tickets without pre-authentication.
+type kdcStandIn struct {
+	net.Listener
+	c *gc.C
+	// keys holds the keys of krbtgt, testUser and the services
+	keys *keytab.Keytab
+	mu   sync.Mutex
+	// issued lists the service principals tickets were issued for
+	issued []string
+}
+
+func newKDCStandIn(c *gc.C) *kdcStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	kdc := &kdcStandIn{Listener: listener, c: c, keys: keytab.New()}
+	now := time.Now()
+	for principal, password := range map[string]string{
+		"krbtgt/" + testRealm: "krbtgt secret",
+		testUser:              testPassword,
+		testSPN:               "service secret",
+		// a service the WinRM listener has no key for
+		"HTTP/other.example.com": "other secret",
+	} {
+		err := kdc.keys.AddEntry(principal, testRealm, password, now, 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+		c.Assert(err, gc.IsNil)
+	}
+	go kdc.serve()
+	return kdc
+}
+
+// krb5Conf writes a krb5.conf pointing to the KDC into dir
+func (kdc *kdcStandIn) krb5Conf(dir string) string {
+	conf := fmt.Sprintf(`[libdefaults]
+  default_realm = %[1]s
+  dns_lookup_kdc = false
+  dns_lookup_realm = false
+  udp_preference_limit = 1
+  default_tkt_enctypes = aes256-cts-hmac-sha1-96
+  default_tgs_enctypes = aes256-cts-hmac-sha1-96
+  permitted_enctypes = aes256-cts-hmac-sha1-96
+
+[realms]
+  %[1]s = {
+    kdc = %[2]s
+  }
+
+[domain_realm]
+  .example.com = %[1]s
+`, testRealm, kdc.Addr())
+	path := filepath.Join(dir, "krb5.conf")
+	kdc.c.Assert(ioutil.WriteFile(path, []byte(conf), 0600), gc.IsNil)
+	return path
+}
+
+// userKeytab writes a keytab holding the key of testUser into dir
+func (kdc *kdcStandIn) userKeytab(dir string) string {
+	kt := keytab.New()
+	err := kt.AddEntry(testUser, testRealm, testPassword, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.c.Assert(err, gc.IsNil)
+	b, err := kt.Marshal()
+	kdc.c.Assert(err, gc.IsNil)
+	path := filepath.Join(dir, "user.keytab")
+	kdc.c.Assert(ioutil.WriteFile(path, b, 0600), gc.IsNil)
+	return path
+}
+
+// serviceKeytab returns the keytab of the WinRM listener of testSPN
+func (kdc *kdcStandIn) serviceKeytab() *keytab.Keytab {
+	kt := keytab.New()
+	err := kt.AddEntry(testSPN, testRealm, "service secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.c.Assert(err, gc.IsNil)
+	return kt
+}
+
+func (kdc *kdcStandIn) serve() {
+	for {
+		conn, err := kdc.Accept()
+		if err != nil {
+			return
+		}
+		go kdc.handle(conn)
+	}
+}
+
+// handle answers a request framed as in RFC 4120 7.2.2
+func (kdc *kdcStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return
+	}
+	req := make([]byte, length)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	rep, err := kdc.reply(req)
+	if err != nil {
+		kdc.c.Error(err)
+		return
+	}
+	frame := make([]byte, 4, 4+len(rep))
+	binary.BigEndian.PutUint32(frame, uint32(len(rep)))
+	conn.Write(append(frame, rep...))
+}
+
+func (kdc *kdcStandIn) reply(req []byte) ([]byte, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	var body messages.KDCReqBody
+	var cname types.PrincipalName
+	var replyKey types.EncryptionKey
+	var usage uint32
+	var rep messages.KDCRepFields
+
+	switch {
+	case req[0] == 0x60|asnAppTag.ASREQ:
+		var asReq messages.ASReq
+		if err := asReq.Unmarshal(req); err != nil {
+			return nil, err
+		}
+		body, cname = asReq.ReqBody, asReq.ReqBody.CName
+		key, _, err := kdc.keys.GetEncryptionKey(cname, testRealm, 0, etypeID.AES256_CTS_HMAC_SHA1_96)
+		if err != nil {
+			return nil, err
+		}
+		replyKey, usage = key, keyusage.AS_REP_ENCPART
+		rep.MsgType = msgtype.KRB_AS_REP
+	case req[0] == 0x60|asnAppTag.TGSREQ:
+		var tgsReq messages.TGSReq
+		if err := tgsReq.Unmarshal(req); err != nil {
+			return nil, err
+		}
+		var apReq messages.APReq
+		for _, pa := range tgsReq.PAData {
+			if pa.PADataType == patype.PA_TGS_REQ {
+				if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := apReq.Ticket.DecryptEncPart(kdc.keys, nil); err != nil {
+			return nil, err
+		}
+		body, cname = tgsReq.ReqBody, apReq.Ticket.DecryptedEncPart.CName
+		replyKey, usage = apReq.Ticket.DecryptedEncPart.Key, keyusage.TGS_REP_ENCPART_SESSION_KEY
+		rep.MsgType = msgtype.KRB_TGS_REP
+		kdc.mu.Lock()
+		kdc.issued = append(kdc.issued, body.SName.PrincipalNameString())
+		kdc.mu.Unlock()
+	default:
+		return nil, fmt.Errorf("unexpected KDC request %x", req[0])
+	}
+
+	end := now.Add(time.Hour)
+	tkt, key, err := messages.NewTicket(cname, testRealm, body.SName, testRealm, types.NewKrbFlags(), kdc.keys, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, end, end)
+	if err != nil {
+		return nil, err
+	}
+	part := messages.EncKDCRepPart{
+		Key:       key,
+		LastReqs:  []messages.LastReq{{LRValue: now}},
+		Nonce:     body.Nonce,
+		Flags:     types.NewKrbFlags(),
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   end,
+		RenewTill: end,
+		SRealm:    testRealm,
+		SName:     body.SName,
+	}
+	b, err := part.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	rep.PVNO, rep.CRealm, rep.CName, rep.Ticket = 5, testRealm, cname, tkt
+	if rep.EncPart, err = crypto.GetEncryptedData(b, replyKey, usage, 1); err != nil {
+		return nil, err
+	}
+	if rep.MsgType == msgtype.KRB_AS_REP {
+		return (&messages.ASRep{KDCRepFields: rep}).Marshal()
+	}
+	return (&messages.TGSRep{KDCRepFields: rep}).Marshal()
+}
+
+// kerberosServer is a WinRM listener accepting service tickets for testSPN
+// and echoing the messages it receives. Like the NTLM one, it
+// authenticates connections rather than requests, and plain http
+// connections must seal their messages.
+type kerberosServer struct {
+	*httptest.Server
+	c    *gc.C
+	keys *keytab.Keytab
+	mu   sync.Mutex
+	// sessions maps the client addresses to their security context
+	sessions   map[string]*kerberosSession
+	handshakes int
+	// mutual selects the response token: "ok", "tampered" or "none"
+	mutual string
+	// raw holds the bodies of the messages posted after authentication
+	raw []string
+}
+
+func newKerberosServer(c *gc.C, keys *keytab.Keytab, tls bool) *kerberosServer {
+	s := &kerberosServer{
+		c:        c,
+		keys:     keys,
+		sessions: make(map[string]*kerberosSession),
+		mutual:   "ok",
+	}
+	if tls {
+		s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	} else {
+		s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	}
+	return s
+}
+
+func (s *kerberosServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	session := s.sessions[r.RemoteAddr]
+	switch {
+	case auth == "" && session != nil:
+		s.raw = append(s.raw, string(body))
+		if r.TLS != nil {
+			w.Write(body)
+			return
+		}
+		msg, err := decryptMessage(session, body)
+		s.c.Assert(err, gc.IsNil)
+		s.c.Assert(r.Header.Get("Content-Type"), gc.Equals, encryptedContentType(kerberosEncryptedProtocol, len(msg)))
+		reply, err := encryptMessage(session, kerberosEncryptedProtocol, msg)
+		s.c.Assert(err, gc.IsNil)
+		w.Header().Set("Content-Type", encryptedContentType(kerberosEncryptedProtocol, len(msg)))
+		w.Write(reply)
+	case strings.HasPrefix(auth, "Negotiate "):
+		token, err := base64.StdEncoding.DecodeString(auth[len("Negotiate "):])
+		s.c.Assert(err, gc.IsNil)
+		apReq, ok := s.verify(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Negotiate")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.handshakes++
+		session := acceptorSession(s.c, apReq)
+		s.sessions[r.RemoteAddr] = session
+		if s.mutual != "none" {
+			w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(s.apRep(apReq, session)))
+		}
+		if r.TLS == nil {
+			s.c.Assert(body, gc.HasLen, 0)
+		}
+		w.Write(body)
+	default:
+		w.Header().Set("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// verify checks the AP-REQ carried by a SPNEGO token
+func (s *kerberosServer) verify(token []byte) (*messages.APReq, bool) {
+	var negToken spnego.SPNEGOToken
+	if err := negToken.Unmarshal(token); err != nil || !negToken.Init {
+		return nil, false
+	}
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(negToken.NegTokenInit.MechTokenBytes); err != nil || !krb5Token.IsAPReq() {
+		return nil, false
+	}
+	apReq := krb5Token.APReq
+	if ok, err := apReq.Verify(s.keys, 5*time.Minute, types.HostAddress{}, nil); !ok || err != nil {
+		return nil, false
+	}
+	s.c.Check(types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired), gc.Equals, true)
+	s.c.Check(binary.LittleEndian.Uint32(apReq.Authenticator.Cksum.Checksum[20:]), gc.Equals, uint32(kerberosContextFlags))
+	return &apReq, true
+}
+
+// acceptorSession returns the server side of the context opened by
+// apReq. Like Windows, the server picks an acceptor subkey.
+func acceptorSession(c *gc.C, apReq *messages.APReq) *kerberosSession {
+	et, err := crypto.GetEtype(etypeID.AES256_CTS_HMAC_SHA1_96)
+	c.Assert(err, gc.IsNil)
+	subkey, err := types.GenerateEncryptionKey(et)
+	c.Assert(err, gc.IsNil)
+	return &kerberosSession{
+		key:            subkey,
+		acceptorSubkey: true,
+		acceptor:       true,
+		sendSeq:        42,
+		recvSeq:        uint64(apReq.Authenticator.SeqNumber),
+	}
+}
+
+// apRep builds the mutual authentication token answering apReq and
+// handing out the key of session
+func (s *kerberosServer) apRep(apReq *messages.APReq, session *kerberosSession) []byte {
+	part := messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		Subkey:         session.key,
+		SequenceNumber: int64(session.sendSeq),
+	}
+	if s.mutual == "tampered" {
+		part.Cusec++
+	}
+	b, err := asn1.Marshal(part)
+	s.c.Assert(err, gc.IsNil)
+	b = asn1tools.AddASNAppTag(b, asnAppTag.EncAPRepPart)
+	encrypted, err := crypto.GetEncryptedData(b, apReq.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	s.c.Assert(err, gc.IsNil)
+	b, err = asn1.Marshal(messages.APRep{PVNO: 5, MsgType: msgtype.KRB_AP_REP, EncPart: encrypted})
+	s.c.Assert(err, gc.IsNil)
+
+	mechToken, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	mechToken = append(mechToken, 0x02, 0x00)
+	mechToken = append(mechToken, asn1tools.AddASNAppTag(b, asnAppTag.APREP)...)
+	resp := spnego.NegTokenResp{
+		NegState:      asn1.Enumerated(spnego.NegStateAcceptCompleted),
+		SupportedMech: gssapi.OIDKRB5.OID(),
+		ResponseToken: asn1tools.AddASNAppTag(mechToken, 0),
+	}
+	token, err := resp.Marshal()
+	s.c.Assert(err, gc.IsNil)
+	return token
+}
+
+// kerberosRequest returns a SoapRequest logging in testUser with a keytab
+func kerberosRequest(c *gc.C, kdc *kdcStandIn, endpoint string) SoapRequest {
+	dir := c.MkDir()
+	return SoapRequest{
+		Endpoint: endpoint,
+		AuthType: "KerberosAuth",
+		Username: testUser + "@" + testRealm,
+		Kerberos: &KerberosCredentials{
+			Krb5Conf: kdc.krb5Conf(dir),
+			Keytab:   kdc.userKeytab(dir),
+			SPN:      testSPN,
+		},
+	}
+}
+
+func (KerberosSuite) TestHttpKerberosAuth(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+	server := newKerberosServer(c, kdc.serviceKeytab(), true)
+	defer server.Close()
+
+	req := kerberosRequest(c, kdc, server.URL)
+	req.HttpInsecure = true
+	for i := 0; i < 3; i++ {
+		resp, err := req.HttpKerberosAuth([]byte("trololol"))
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, "trololol")
+	}
+	// the authenticated connection and the service ticket are reused
+	c.Assert(server.handshakes, gc.Equals, 1)
+	c.Assert(kdc.issued, gc.DeepEquals, []string{testSPN})
+	c.Assert(server.raw, gc.DeepEquals, []string{"trololol", "trololol"})
+}
+
+func (KerberosSuite) TestHttpKerberosAuthEncrypted(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+	server := newKerberosServer(c, kdc.serviceKeytab(), false)
+	defer server.Close()
+
+	req := kerberosRequest(c, kdc, server.URL)
+	for i := 0; i < 3; i++ {
+		resp, err := req.HttpKerberosAuth([]byte("trololol"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(resp.StatusCode, gc.Equals, 200)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, "trololol")
+	}
+	c.Assert(server.handshakes, gc.Equals, 1)
+	c.Assert(server.raw, gc.HasLen, 3)
+	for _, raw := range server.raw {
+		c.Assert(strings.Contains(raw, "trololol"), gc.Equals, false)
+	}
+}
+
+func (KerberosSuite) TestHttpKerberosAuthPassword(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+	server := newKerberosServer(c, kdc.serviceKeytab(), false)
+	defer server.Close()
+
+	req := kerberosRequest(c, kdc, server.URL)
+	req.Username, req.Passwd, req.Kerberos.Keytab = testUser, testPassword, ""
+	resp, err := req.HttpKerberosAuth([]byte("trololol"))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(server.handshakes, gc.Equals, 1)
+}
+
+func (KerberosSuite) TestHttpKerberosAuthMutualFailure(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+	server := newKerberosServer(c, kdc.serviceKeytab(), false)
+	defer server.Close()
+
+	req := kerberosRequest(c, kdc, server.URL)
+	server.mutual = "tampered"
+	resp, err := req.HttpKerberosAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Kerberos mutual authentication failed: authenticator mismatch")
+
+	server.mutual = "none"
+	resp, err = req.HttpKerberosAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Kerberos mutual authentication failed: no response token")
+}
+
+func (KerberosSuite) TestHttpKerberosAuthUnknownSPN(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+	server := newKerberosServer(c, kdc.serviceKeytab(), false)
+	defer server.Close()
+
+	// the KDC issues the ticket, but the server has no key for it
+	req := kerberosRequest(c, kdc, server.URL)
+	req.Kerberos.SPN = "HTTP/other.example.com"
+	resp, err := req.HttpKerberosAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Remote host returned error status code: 401")
+}
+
+func (KerberosSuite) TestHttpKerberosAuthMissingKeytab(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+
+	req := kerberosRequest(c, kdc, "http://winrm.example.com:5985/wsman")
+	req.Kerberos.Keytab = filepath.Join(c.MkDir(), "missing.keytab")
+	resp, err := req.HttpKerberosAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Cannot load Kerberos keytab .*missing.keytab: .*")
+}
+
+func (KerberosSuite) TestSendMessageKerberosAuthNeedsSecret(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+
+	req := kerberosRequest(c, kdc, "http://winrm.example.com:5985/wsman")
+	req.Kerberos.Keytab = ""
+	resp, err := req.SendMessage(&Envelope{})
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "AuthType KerberosAuth needs a Keytab, a CCache or Passwd")
+}
+
+func (KerberosSuite) TestSendMessageAutoKerberosCCache(c *gc.C) {
+	kdc := newKDCStandIn(c)
+	defer kdc.Close()
+	server := newKerberosServer(c, kdc.serviceKeytab(), false)
+	defer server.Close()
+
+	// the principal comes from the credential cache, there is no Username
+	req := kerberosRequest(c, kdc, server.URL)
+	req.AuthType, req.Username = "Auto", ""
+	req.Kerberos.Keytab, req.Kerberos.CCache = "", filepath.Join(c.MkDir(), "krb5cc")
+	resp, err := req.SendMessage(&Envelope{})
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Cannot load Kerberos credential cache .*krb5cc: .*")
+}
+
+func (KerberosSuite) TestKerberosSPN(c *gc.C) {
+	for _, t := range []struct {
+		endpoint string
+		spn      string
+		expected string
+	}{
+		{"https://winrm.example.com:5986/wsman", "", "HTTP/winrm.example.com"},
+		{"http://winrm.example.com/wsman", "", "HTTP/winrm.example.com"},
+		{"http://10.0.0.5:5985/wsman", "HTTP/winrm.example.com", "HTTP/winrm.example.com"},
+		{"http://alias.example.com:5985/wsman", "HTTP/winrm.example.com", "HTTP/winrm.example.com"},
+	} {
+		spn, err := kerberosSPN(t.endpoint, &KerberosCredentials{SPN: t.spn})
+		c.Check(err, gc.IsNil)
+		c.Check(spn, gc.Equals, t.expected)
+	}
+}
+
+func (KerberosSuite) TestKerberosPrincipal(c *gc.C) {
+	user, realm := kerberosPrincipal("alice@example.com", "OTHER.COM")
+	c.Assert(user, gc.Equals, "alice")
+	c.Assert(realm, gc.Equals, "EXAMPLE.COM")
+
+	user, realm = kerberosPrincipal("alice", "OTHER.COM")
+	c.Assert(user, gc.Equals, "alice")
+	c.Assert(realm, gc.Equals, "OTHER.COM")
+}
+
+// kerberosPair returns both sides of a context sealing with a fixed key
+func kerberosPair(keyType int32, key string) (*kerberosSession, *kerberosSession) {
+	k := types.EncryptionKey{KeyType: keyType, KeyValue: unhex(key)}
+	client := &kerberosSession{key: k, acceptorSubkey: true, sendSeq: 7, recvSeq: 42}
+	server := &kerberosSession{key: k, acceptorSubkey: true, acceptor: true, sendSeq: 42, recvSeq: 7}
+	return client, server
+}
+
+func (KerberosSuite) TestKerberosSessionRoundTrip(c *gc.C) {
+	for _, t := range []struct {
+		keyType int32
+		key     string
+	}{
+		{etypeID.AES128_CTS_HMAC_SHA1_96, "9062430c8cda3388922e6d6a509f5b7a"},
+		{etypeID.AES256_CTS_HMAC_SHA1_96, "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+	} {
+		client, server := kerberosPair(t.keyType, t.key)
+		for i, msg := range []string{"trololol", strings.Repeat("<s:Envelope/>", 100)} {
+			signature, sealed, err := client.Wrap([]byte(msg))
+			c.Assert(err, gc.IsNil)
+			// header, rotated encrypted header and checksum, confounder
+			c.Assert(signature, gc.HasLen, 16+28+16)
+			c.Assert(signature[:16], gc.DeepEquals, wrapHeader(gssSealed|gssAcceptorSubkey, 0, 28, uint64(7+i)))
+			c.Assert(sealed, gc.HasLen, len(msg))
+			c.Assert(string(sealed), gc.Not(gc.Equals), msg)
+
+			plain, err := server.Unwrap(signature, sealed)
+			c.Assert(err, gc.IsNil)
+			c.Assert(string(plain), gc.Equals, msg)
+
+			signature, sealed, err = server.Wrap([]byte(msg))
+			c.Assert(err, gc.IsNil)
+			c.Assert(signature[2], gc.Equals, byte(gssSentByAcceptor|gssSealed|gssAcceptorSubkey))
+			plain, err = client.Unwrap(signature, sealed)
+			c.Assert(err, gc.IsNil)
+			c.Assert(string(plain), gc.Equals, msg)
+		}
+	}
+}
+
+func (KerberosSuite) TestKerberosSessionUnwrapErrors(c *gc.C) {
+	client, server := kerberosPair(etypeID.AES256_CTS_HMAC_SHA1_96, "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161")
+	signature, sealed, err := client.Wrap([]byte("trololol"))
+	c.Assert(err, gc.IsNil)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[0] ^= 1
+	_, err = server.Unwrap(signature, tampered)
+	c.Assert(err, gc.ErrorMatches, "Invalid Kerberos wrap token signature")
+
+	// a token is not accepted back by its sender
+	_, err = client.Unwrap(signature, sealed)
+	c.Assert(err, gc.ErrorMatches, "Invalid Kerberos wrap token")
+
+	_, err = server.Unwrap(signature, sealed)
+	c.Assert(err, gc.IsNil)
+	_, err = server.Unwrap(signature, sealed)
+	c.Assert(err, gc.ErrorMatches, "Invalid Kerberos wrap token sequence number")
+
+	_, err = server.Unwrap(signature[:10], nil)
+	c.Assert(err, gc.ErrorMatches, "Invalid Kerberos wrap token")
+}
+
+func (KerberosSuite) TestKerberosSessionRC4(c *gc.C) {
+	client, _ := kerberosPair(etypeID.RC4_HMAC, "00112233445566778899aabbccddeeff")
+	_, _, err := client.Wrap([]byte("trololol"))
+	c.Assert(err, gc.ErrorMatches, "Kerberos message encryption does not support encryption type 23")
+}
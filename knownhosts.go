@@ -0,0 +1,242 @@
+package winrm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KnownHosts records the certificates of WinRM listeners the first time
+// they are reached, and then only trusts those, as SSH does with host
+// keys. It suits listeners with a self-signed certificate. The file has
+// a line per endpoint, with its host:port and the Fingerprint of its
+// certificate; blank lines and lines starting with # are ignored.
+type KnownHosts struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// NewKnownHosts returns the KnownHosts stored in the file at path, which
+// is created on the first certificate recorded
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{Path: path}
+}
+
+// HostKeyMismatchError is returned when the certificate of a listener is
+// not the one recorded in its KnownHosts. It may have been renewed, or
+// someone may be impersonating the listener.
+type HostKeyMismatchError struct {
+	// Host is the host:port of the listener
+	Host string
+	// Known is the recorded fingerprint, Presented the one of the
+	// certificate the listener presented
+	Known     string
+	Presented string
+	// Path and Line locate the record of Known
+	Path string
+	Line int
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("Certificate of %s has changed: expected %s as recorded at %s:%d, got %s. If the change is expected, accept it with KnownHosts.Accept or winrm-known-hosts accept",
+		e.Host, e.Known, e.Path, e.Line, e.Presented)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of cert, as recorded in a
+// KnownHosts file
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// EndpointHost returns the host:port an endpoint is recorded under
+func EndpointHost(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return "", errors.New(fmt.Sprintf("Invalid https endpoint: %s", endpoint))
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port), nil
+}
+
+// knownHost is a line of a KnownHosts file
+type knownHost struct {
+	host        string
+	fingerprint string
+	line        int
+}
+
+// read parses the file, returning its lines and the records they hold. A
+// missing file holds no record.
+func (k *KnownHosts) read() ([]string, []knownHost, error) {
+	content, err := ioutil.ReadFile(k.Path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var lines []string
+	var hosts []knownHost
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		lines = append(lines, line)
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		fields := strings.Fields(trimmed)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "SHA256:") {
+			return nil, nil, errors.New(fmt.Sprintf("Invalid line %d in %s", len(lines), k.Path))
+		}
+		hosts = append(hosts, knownHost{host: fields[0], fingerprint: fields[1], line: len(lines)})
+	}
+	return lines, hosts, scanner.Err()
+}
+
+// write replaces the file with lines, through a temporary file so that
+// concurrent readers never see it half written
+func (k *KnownHosts) write(lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(k.Path), filepath.Base(k.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.Path)
+}
+
+// Lookup returns the fingerprint recorded for host, given as host:port
+func (k *KnownHosts) Lookup(host string) (string, bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, hosts, err := k.read()
+	if err != nil {
+		return "", false, err
+	}
+	for _, known := range hosts {
+		if known.host == host {
+			return known.fingerprint, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Accept records fingerprint for host, given as host:port, replacing any
+// fingerprint recorded before
+func (k *KnownHosts) Accept(host, fingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.replace(host, host+" "+fingerprint)
+}
+
+// Remove forgets the fingerprint recorded for host, given as host:port
+func (k *KnownHosts) Remove(host string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.replace(host, "")
+}
+
+// replace puts record in place of the lines of host, or at the end of
+// the file if there is none. An empty record removes the lines of host.
+func (k *KnownHosts) replace(host, record string) error {
+	lines, hosts, err := k.read()
+	if err != nil {
+		return err
+	}
+	removed := make(map[int]bool)
+	for _, known := range hosts {
+		if known.host == host {
+			removed[known.line] = true
+		}
+	}
+	var updated []string
+	for i, line := range lines {
+		if !removed[i+1] {
+			updated = append(updated, line)
+		} else if record != "" {
+			updated, record = append(updated, record), ""
+		}
+	}
+	if record != "" {
+		updated = append(updated, record)
+	}
+	return k.write(updated)
+}
+
+// Check verifies that cert is the certificate recorded for host, given as
+// host:port, recording it if host is unknown. A different certificate
+// gives a *HostKeyMismatchError.
+func (k *KnownHosts) Check(host string, cert *x509.Certificate) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, hosts, err := k.read()
+	if err != nil {
+		return err
+	}
+	presented := Fingerprint(cert)
+	for _, known := range hosts {
+		if known.host != host {
+			continue
+		}
+		if known.fingerprint != presented {
+			return &HostKeyMismatchError{Host: host, Known: known.fingerprint, Presented: presented, Path: k.Path, Line: known.line}
+		}
+		return nil
+	}
+	return k.replace(host, host+" "+presented)
+}
+
+// FetchCertificate connects to the https endpoint and returns the
+// certificate it presents, without verifying it, so that it can be
+// accepted in a KnownHosts
+func FetchCertificate(ctx context.Context, endpoint string) (*x509.Certificate, error) {
+	host, err := EndpointHost(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("Server presented no certificate")
+	}
+	return certs[0], nil
+}
@@ -0,0 +1,126 @@
+package winrm
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+
+	gc "launchpad.net/gocheck"
+)
+
+type KnownHostsSuite struct{}
+
+var _ = gc.Suite(KnownHostsSuite{})
+
+func (KnownHostsSuite) TestEndpointHost(c *gc.C) {
+	for endpoint, host := range map[string]string{
+		"https://WinHost.contoso.com:5986/wsman": "winhost.contoso.com:5986",
+		"https://10.0.0.12/wsman":                "10.0.0.12:443",
+		"https://[fe80::1]:5986/wsman":           "[fe80::1]:5986",
+	} {
+		got, err := EndpointHost(endpoint)
+		c.Assert(err, gc.IsNil)
+		c.Assert(got, gc.Equals, host)
+	}
+	_, err := EndpointHost("http://winhost:5985/wsman")
+	c.Assert(err, gc.ErrorMatches, "Invalid https endpoint: http://winhost:5985/wsman")
+}
+
+func (KnownHostsSuite) TestKnownHostsTrustOnFirstUse(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+	path := filepath.Join(c.MkDir(), "winrm", "known_hosts")
+	host, err := EndpointHost(server.URL)
+	c.Assert(err, gc.IsNil)
+
+	for i := 0; i < 2; i++ {
+		client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithKnownHosts(path))
+		c.Assert(err, gc.IsNil)
+		c.Assert(executeCommand(client), gc.IsNil)
+	}
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(content), gc.Equals, host+" "+Fingerprint(server.Certificate())+"\n")
+}
+
+func (KnownHostsSuite) TestKnownHostsMismatch(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+	path := filepath.Join(c.MkDir(), "known_hosts")
+	host, err := EndpointHost(server.URL)
+	c.Assert(err, gc.IsNil)
+	stale := "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"
+	c.Assert(ioutil.WriteFile(path, []byte("# lab hosts\n"+host+" "+stale+"\n"), 0600), gc.IsNil)
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithKnownHosts(path))
+	c.Assert(err, gc.IsNil)
+	err = executeCommand(client)
+	var mismatch *HostKeyMismatchError
+	c.Assert(errors.As(err, &mismatch), gc.Equals, true)
+	presented := Fingerprint(server.Certificate())
+	c.Assert(*mismatch, gc.Equals, HostKeyMismatchError{Host: host, Known: stale, Presented: presented, Path: path, Line: 2})
+	c.Assert(mismatch.Error(), gc.Equals, "Certificate of "+host+" has changed: expected "+stale+" as recorded at "+path+
+		":2, got "+presented+". If the change is expected, accept it with KnownHosts.Accept or winrm-known-hosts accept")
+	c.Assert(server.seen(), gc.HasLen, 0)
+
+	// accepting the new certificate keeps the other lines
+	cert, err := FetchCertificate(context.Background(), server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(client.soap.KnownHosts.Accept(host, Fingerprint(cert)), gc.IsNil)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(content), gc.Equals, "# lab hosts\n"+host+" "+presented+"\n")
+	c.Assert(executeCommand(client), gc.IsNil)
+}
+
+func (KnownHostsSuite) TestKnownHostsWithCA(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+	path := filepath.Join(c.MkDir(), "known_hosts")
+	host, err := EndpointHost(server.URL)
+	c.Assert(err, gc.IsNil)
+	ca := writeCA(c, server)
+
+	// the chain is still verified against the CA
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithKnownHosts(path),
+		WithServerVerification(&ServerVerification{CA: ca, ServerName: "winhost.contoso.com"}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.ErrorMatches, ".*certificate is valid for .*, not winhost.contoso.com")
+	_, known, err := client.soap.KnownHosts.Lookup(host)
+	c.Assert(err, gc.IsNil)
+	c.Assert(known, gc.Equals, false)
+
+	client, err = NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"), WithKnownHosts(path),
+		WithServerVerification(&ServerVerification{CA: ca}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(executeCommand(client), gc.IsNil)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(content), gc.Equals, host+" "+Fingerprint(server.Certificate())+"\n")
+}
+
+func (KnownHostsSuite) TestKnownHostsEdit(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "known_hosts")
+	known := NewKnownHosts(path)
+	_, found, err := known.Lookup("winhost:5986")
+	c.Assert(err, gc.IsNil)
+	c.Assert(found, gc.Equals, false)
+
+	c.Assert(known.Accept("a:5986", "SHA256:a"), gc.IsNil)
+	c.Assert(known.Accept("b:5986", "SHA256:b"), gc.IsNil)
+	c.Assert(known.Accept("a:5986", "SHA256:c"), gc.IsNil)
+	fingerprint, found, err := known.Lookup("a:5986")
+	c.Assert(err, gc.IsNil)
+	c.Assert(found, gc.Equals, true)
+	c.Assert(fingerprint, gc.Equals, "SHA256:c")
+
+	c.Assert(known.Remove("a:5986"), gc.IsNil)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(content), gc.Equals, "b:5986 SHA256:b\n")
+
+	c.Assert(ioutil.WriteFile(path, []byte("b:5986\n"), 0600), gc.IsNil)
+	_, _, err = known.Lookup("b:5986")
+	c.Assert(err, gc.ErrorMatches, "Invalid line 1 in .*known_hosts")
+}
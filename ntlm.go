@@ -0,0 +1,303 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM negotiate flags, see MS-NLMP 2.2.2.5
+const (
+	ntlmNegotiateUnicode         = 0x00000001
+	ntlmRequestTarget            = 0x00000004
+	ntlmNegotiateSign            = 0x00000010
+	ntlmNegotiateSeal            = 0x00000020
+	ntlmNegotiateNTLM            = 0x00000200
+	ntlmNegotiateAlwaysSign      = 0x00008000
+	ntlmNegotiateExtendedSession = 0x00080000
+	ntlmNegotiateTargetInfo      = 0x00800000
+	ntlmNegotiate128             = 0x20000000
+	ntlmNegotiateKeyExch         = 0x40000000
+	ntlmNegotiate56              = 0x80000000
+)
+
+const ntlmClientFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateSign |
+	ntlmNegotiateSeal | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+	ntlmNegotiateExtendedSession | ntlmNegotiateTargetInfo | ntlmNegotiate128 |
+	ntlmNegotiateKeyExch | ntlmNegotiate56
+
+// AV pair ids found in the target info of a challenge message
+const (
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmChallenge holds the fields of a CHALLENGE_MESSAGE (type 2) that are
+// needed to answer it
+type ntlmChallenge struct {
+	Flags           uint32
+	ServerChallenge []byte
+	TargetInfo      []byte
+}
+
+// ntlmSession is the outcome of a successful handshake. It holds the
+// keys and RC4 handles sealing the messages of one connection.
+type ntlmSession struct {
+	Flags      uint32
+	SessionKey []byte
+
+	clientSigningKey []byte
+	serverSigningKey []byte
+	clientSeal       *rc4.Cipher
+	serverSeal       *rc4.Cipher
+	clientSeq        uint32
+	serverSeq        uint32
+}
+
+// newNTLMSession derives the signing and sealing keys of a client session,
+// MS-NLMP 3.4.5
+func newNTLMSession(flags uint32, sessionKey []byte) (*ntlmSession, error) {
+	session := &ntlmSession{Flags: flags, SessionKey: sessionKey}
+	sealKey := sessionKey
+	if flags&ntlmNegotiate128 == 0 {
+		if flags&ntlmNegotiate56 != 0 {
+			sealKey = sessionKey[:7]
+		} else {
+			sealKey = sessionKey[:5]
+		}
+	}
+	derive := func(key []byte, magic string) []byte {
+		hash := md5.New()
+		hash.Write(key)
+		hash.Write([]byte(magic))
+		return hash.Sum(nil)
+	}
+	session.clientSigningKey = derive(sessionKey, "session key to client-to-server signing key magic constant\x00")
+	session.serverSigningKey = derive(sessionKey, "session key to server-to-client signing key magic constant\x00")
+	var err error
+	session.clientSeal, err = rc4.NewCipher(derive(sealKey, "session key to client-to-server sealing key magic constant\x00"))
+	if err != nil {
+		return nil, err
+	}
+	session.serverSeal, err = rc4.NewCipher(derive(sealKey, "session key to server-to-client sealing key magic constant\x00"))
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// signature computes the message signature of MS-NLMP 3.4.4.2
+func (session *ntlmSession) signature(signingKey []byte, seal *rc4.Cipher, seq uint32, msg []byte) []byte {
+	sig := make([]byte, 16)
+	binary.LittleEndian.PutUint32(sig, 1)
+	binary.LittleEndian.PutUint32(sig[12:], seq)
+	copy(sig[4:12], hmacMD5(signingKey, sig[12:], msg))
+	if session.Flags&ntlmNegotiateKeyExch != 0 {
+		seal.XORKeyStream(sig[4:12], sig[4:12])
+	}
+	return sig
+}
+
+// Wrap seals msg for the server and returns its signature and the
+// encrypted message
+func (session *ntlmSession) Wrap(msg []byte) ([]byte, []byte, error) {
+	sealed := make([]byte, len(msg))
+	session.clientSeal.XORKeyStream(sealed, msg)
+	sig := session.signature(session.clientSigningKey, session.clientSeal, session.clientSeq, msg)
+	session.clientSeq++
+	return sig, sealed, nil
+}
+
+// Unwrap decrypts a message sealed by the server and checks its signature
+func (session *ntlmSession) Unwrap(sig, sealed []byte) ([]byte, error) {
+	if len(sig) != 16 {
+		return nil, errors.New("Invalid NTLM message signature")
+	}
+	msg := make([]byte, len(sealed))
+	session.serverSeal.XORKeyStream(msg, sealed)
+	expected := session.signature(session.serverSigningKey, session.serverSeal, session.serverSeq, msg)
+	session.serverSeq++
+	if !hmac.Equal(sig, expected) {
+		return nil, errors.New("Invalid NTLM message signature")
+	}
+	return msg, nil
+}
+
+// ntlmNegotiateMessage returns the NEGOTIATE_MESSAGE (type 1) opening a
+// handshake
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmClientFlags)
+	return msg
+}
+
+// parseNTLMChallenge decodes a CHALLENGE_MESSAGE (type 2)
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 48 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("Invalid NTLM challenge message")
+	}
+	challenge := &ntlmChallenge{
+		Flags:           binary.LittleEndian.Uint32(msg[20:]),
+		ServerChallenge: append([]byte(nil), msg[24:32]...),
+	}
+	length := int(binary.LittleEndian.Uint16(msg[40:]))
+	offset := int(binary.LittleEndian.Uint32(msg[44:]))
+	if offset+length > len(msg) {
+		return nil, errors.New("Invalid NTLM challenge message")
+	}
+	challenge.TargetInfo = append([]byte(nil), msg[offset:offset+length]...)
+	if challenge.Flags&ntlmNegotiateUnicode == 0 {
+		return nil, errors.New("NTLM server does not support unicode")
+	}
+	return challenge, nil
+}
+
+// timestamp returns the MsvAvTimestamp AV pair of the challenge, if any
+func (challenge *ntlmChallenge) timestamp() []byte {
+	info := challenge.TargetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || 4+length > len(info) {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+	return nil
+}
+
+// ntlmUserDomain splits DOMAIN\user logons. Other user names, including
+// user@domain principals, are sent as is with an empty domain.
+func ntlmUserDomain(username string) (string, string) {
+	if i := strings.Index(username, `\`); i >= 0 {
+		return username[i+1:], username[:i]
+	}
+	return username, ""
+}
+
+func utf16le(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(codes))
+	for i, code := range codes {
+		binary.LittleEndian.PutUint16(b[2*i:], code)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// ntowfv2 derives the NTLMv2 response key, MS-NLMP 3.3.2
+func ntowfv2(user, domain, password string) []byte {
+	hash := md4.New()
+	hash.Write(utf16le(password))
+	return hmacMD5(hash.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+}
+
+// ntlmv2Response computes the NTLMv2 challenge responses and the session
+// base key, MS-NLMP 3.3.2
+func ntlmv2Response(responseKey []byte, challenge *ntlmChallenge, clientChallenge, timestamp []byte) (nt, lm, sessionBaseKey []byte) {
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(challenge.TargetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	proof := hmacMD5(responseKey, challenge.ServerChallenge, temp.Bytes())
+	nt = append(proof, temp.Bytes()...)
+	lm = append(hmacMD5(responseKey, challenge.ServerChallenge, clientChallenge), clientChallenge...)
+	sessionBaseKey = hmacMD5(responseKey, proof)
+	return nt, lm, sessionBaseKey
+}
+
+// filetime converts t to a little endian Windows FILETIME
+func filetime(t time.Time) []byte {
+	ft := make([]byte, 8)
+	ticks := t.Unix()*10000000 + int64(t.Nanosecond()/100) + 116444736000000000
+	binary.LittleEndian.PutUint64(ft, uint64(ticks))
+	return ft
+}
+
+// ntlmAuthenticateMessage answers challenge with an AUTHENTICATE_MESSAGE
+// (type 3). random supplies the client challenge and the exported session
+// key.
+func ntlmAuthenticateMessage(username, password string, challenge *ntlmChallenge, now time.Time, random io.Reader) ([]byte, *ntlmSession, error) {
+	user, domain := ntlmUserDomain(username)
+	clientChallenge := make([]byte, 8)
+	if _, err := io.ReadFull(random, clientChallenge); err != nil {
+		return nil, nil, err
+	}
+
+	timestamp := challenge.timestamp()
+	serverTimestamp := timestamp != nil
+	if !serverTimestamp {
+		timestamp = filetime(now)
+	}
+	responseKey := ntowfv2(user, domain, password)
+	nt, lm, keyExchangeKey := ntlmv2Response(responseKey, challenge, clientChallenge, timestamp)
+	if serverTimestamp {
+		// MS-NLMP 3.1.5.1.2: no LMv2 response when the server sent a timestamp
+		lm = make([]byte, 24)
+	}
+
+	flags := challenge.Flags & ntlmClientFlags
+	sessionKey := keyExchangeKey
+	var encryptedKey []byte
+	if flags&ntlmNegotiateKeyExch != 0 {
+		sessionKey = make([]byte, 16)
+		if _, err := io.ReadFull(random, sessionKey); err != nil {
+			return nil, nil, err
+		}
+		cipher, err := rc4.NewCipher(keyExchangeKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		encryptedKey = make([]byte, 16)
+		cipher.XORKeyStream(encryptedKey, sessionKey)
+	}
+	session, err := newNTLMSession(flags, sessionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(user), nil, encryptedKey}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		header := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(header, uint16(len(field)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	return msg, session, nil
+}
+
+// ntlmRandom is the source of client challenges and session keys
+var ntlmRandom io.Reader = rand.Reader
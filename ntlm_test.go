@@ -0,0 +1,422 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	gc "launchpad.net/gocheck"
+)
+
+type NTLMSuite struct{}
+
+var _ = gc.Suite(NTLMSuite{})
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// avPair encodes a single AV pair of a challenge target info
+func avPair(id uint16, value []byte) []byte {
+	pair := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint16(pair, id)
+	binary.LittleEndian.PutUint16(pair[2:], uint16(len(value)))
+	return append(pair, value...)
+}
+
+// ntlmChallengeMessage builds a CHALLENGE_MESSAGE as sent by a server
+func ntlmChallengeMessage(flags uint32, serverChallenge, targetInfo []byte) []byte {
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, targetInfo...)
+}
+
+// MS-NLMP 4.2.4 NTLMv2 authentication test vectors
+var (
+	vectorTargetInfo = bytes.Join([][]byte{
+		avPair(2, utf16le("Domain")),
+		avPair(1, utf16le("Server")),
+		avPair(ntlmAvEOL, nil),
+	}, nil)
+	vectorChallenge = &ntlmChallenge{
+		Flags:           0xe28a8233,
+		ServerChallenge: unhex("0123456789abcdef"),
+		TargetInfo:      vectorTargetInfo,
+	}
+	vectorClientChallenge = unhex("aaaaaaaaaaaaaaaa")
+	vectorSessionKey      = unhex("55555555555555555555555555555555")
+)
+
+func (NTLMSuite) TestNTOWFv2(c *gc.C) {
+	c.Assert(ntowfv2("User", "Domain", "Password"), gc.DeepEquals, unhex("0c868a403bfd7a93a3001ef22ef02e3f"))
+}
+
+func (NTLMSuite) TestNTLMv2Response(c *gc.C) {
+	key := ntowfv2("User", "Domain", "Password")
+	nt, lm, sessionBaseKey := ntlmv2Response(key, vectorChallenge, vectorClientChallenge, make([]byte, 8))
+	c.Assert(nt[:16], gc.DeepEquals, unhex("68cd0ab851e51c96aabc927bebef6a1c"))
+	c.Assert(lm, gc.DeepEquals, unhex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"))
+	c.Assert(sessionBaseKey, gc.DeepEquals, unhex("8de40ccadbc14a82f15cb0ad0de95ca3"))
+}
+
+func (NTLMSuite) TestNTLMAuthenticateMessage(c *gc.C) {
+	random := bytes.NewReader(append(vectorClientChallenge, vectorSessionKey...))
+	// the test vectors use a zero timestamp, the FILETIME epoch
+	epoch := time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg, session, err := ntlmAuthenticateMessage(`Domain\User`, "Password", vectorChallenge, epoch, random)
+	c.Assert(err, gc.IsNil)
+	c.Assert(session.SessionKey, gc.DeepEquals, vectorSessionKey)
+	c.Assert(session.Flags, gc.Equals, uint32(0xe28a8233&ntlmClientFlags))
+
+	field := func(i int) []byte {
+		length := binary.LittleEndian.Uint16(msg[12+8*i:])
+		offset := binary.LittleEndian.Uint32(msg[16+8*i:])
+		return msg[offset : offset+uint32(length)]
+	}
+	c.Assert(string(msg[:8]), gc.Equals, "NTLMSSP\x00")
+	c.Assert(binary.LittleEndian.Uint32(msg[8:]), gc.Equals, uint32(3))
+	c.Assert(field(0), gc.DeepEquals, unhex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"))
+	c.Assert(field(2), gc.DeepEquals, utf16le("Domain"))
+	c.Assert(field(3), gc.DeepEquals, utf16le("User"))
+	c.Assert(field(4), gc.HasLen, 0)
+	c.Assert(field(5), gc.DeepEquals, unhex("c5dad2544fc9799094ce1ce90bc9d03e"))
+}
+
+func (NTLMSuite) TestNTLMAuthenticateMessageServerTimestamp(c *gc.C) {
+	challenge := &ntlmChallenge{
+		Flags:           vectorChallenge.Flags,
+		ServerChallenge: vectorChallenge.ServerChallenge,
+		TargetInfo: bytes.Join([][]byte{
+			avPair(ntlmAvTimestamp, unhex("0090d336b734c301")),
+			avPair(ntlmAvEOL, nil),
+		}, nil),
+	}
+	msg, _, err := ntlmAuthenticateMessage("User", "Password", challenge, time.Now(), bytes.NewReader(make([]byte, 24)))
+	c.Assert(err, gc.IsNil)
+	// the LMv2 response is zeroed and the blob carries the server time
+	lmOffset := binary.LittleEndian.Uint32(msg[16:])
+	c.Assert(msg[lmOffset:lmOffset+24], gc.DeepEquals, make([]byte, 24))
+	ntOffset := binary.LittleEndian.Uint32(msg[24:])
+	c.Assert(msg[ntOffset+24:ntOffset+32], gc.DeepEquals, unhex("0090d336b734c301"))
+}
+
+func (NTLMSuite) TestParseNTLMChallenge(c *gc.C) {
+	msg := ntlmChallengeMessage(0xe28a8233, unhex("0123456789abcdef"), vectorTargetInfo)
+	challenge, err := parseNTLMChallenge(msg)
+	c.Assert(err, gc.IsNil)
+	c.Assert(challenge, gc.DeepEquals, vectorChallenge)
+
+	_, err = parseNTLMChallenge(msg[:40])
+	c.Assert(err, gc.ErrorMatches, "Invalid NTLM challenge message")
+	_, err = parseNTLMChallenge(ntlmNegotiateMessage())
+	c.Assert(err, gc.ErrorMatches, "Invalid NTLM challenge message")
+}
+
+func (NTLMSuite) TestNTLMUserDomain(c *gc.C) {
+	user, domain := ntlmUserDomain(`CONTOSO\Administrator`)
+	c.Assert(user, gc.Equals, "Administrator")
+	c.Assert(domain, gc.Equals, "CONTOSO")
+	user, domain = ntlmUserDomain("Administrator@contoso.com")
+	c.Assert(user, gc.Equals, "Administrator@contoso.com")
+	c.Assert(domain, gc.Equals, "")
+}
+
+// recordedChallenge is a challenge in the shape sent by a WinRM listener
+// on host WINHOST of the contoso.com domain, including a server timestamp
+var recordedChallenge = "TlRMTVNTUAACAAAADgAOADgAAAA1gorilqqRErGgMjQAAAAAAAAAAIgAiABGAAAABgOAJQAAAA9XAEkATgBIAE8AUwBUAAIADgBXAEkATgBIAE8AUwBUAAEADgBXAEkATgBIAE8AUwBUAAQAJgB3AGkAbgBoAG8AcwB0AC4AYwBvAG4AdABvAHMAbwAuAGMAbwBtAAMAJgB3AGkAbgBoAG8AcwB0AC4AYwBvAG4AdABvAHMAbwAuAGMAbwBtAAcACAC4dUVmF7XQAQAAAAA="
+
+// ntlmServer emulates the connection based NTLM authentication of a
+// WinRM listener: a connection is only served once it completed the
+// handshake, and a handshake must run on a single connection. Plain http
+// connections must seal their messages, which the server echoes back.
+type ntlmServer struct {
+	*httptest.Server
+	c        *gc.C
+	password string
+	mu       sync.Mutex
+	// state maps a client address to its handshake progress
+	state      map[string]string
+	sessions   map[string]*ntlmSession
+	handshakes int
+	// raw holds the bodies of the messages posted after authentication
+	raw []string
+}
+
+func newNTLMServer(c *gc.C, password string, tls bool) *ntlmServer {
+	s := &ntlmServer{
+		c:        c,
+		password: password,
+		state:    make(map[string]string),
+		sessions: make(map[string]*ntlmSession),
+	}
+	if tls {
+		s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	} else {
+		s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	}
+	return s
+}
+
+func (s *ntlmServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	switch {
+	case auth == "" && s.state[r.RemoteAddr] == "authenticated":
+		s.raw = append(s.raw, string(body))
+		if r.TLS != nil {
+			w.Write(body)
+			return
+		}
+		session := s.sessions[r.RemoteAddr]
+		msg, err := decryptMessage(session, body)
+		s.c.Assert(err, gc.IsNil)
+		s.c.Assert(r.Header.Get("Content-Type"), gc.Equals, encryptedContentType(spnegoEncryptedProtocol, len(msg)))
+		reply, err := encryptMessage(session, spnegoEncryptedProtocol, msg)
+		s.c.Assert(err, gc.IsNil)
+		w.Header().Set("Content-Type", encryptedContentType(spnegoEncryptedProtocol, len(msg)))
+		w.Write(reply)
+	case strings.HasPrefix(auth, "Negotiate "):
+		token, err := base64.StdEncoding.DecodeString(auth[len("Negotiate "):])
+		s.c.Assert(err, gc.IsNil)
+		switch binary.LittleEndian.Uint32(token[8:]) {
+		case 1:
+			s.c.Assert(body, gc.HasLen, 0)
+			s.state[r.RemoteAddr] = "challenged"
+			w.Header().Set("WWW-Authenticate", "Negotiate "+recordedChallenge)
+			w.WriteHeader(http.StatusUnauthorized)
+		case 3:
+			session := s.verify(token)
+			if s.state[r.RemoteAddr] != "challenged" || session == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			s.handshakes++
+			s.state[r.RemoteAddr] = "authenticated"
+			s.sessions[r.RemoteAddr] = session
+			if r.TLS == nil {
+				s.c.Assert(body, gc.HasLen, 0)
+			}
+			w.Write(body)
+		}
+	default:
+		w.Header().Add("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// verify checks the NTLMv2 proof of an AUTHENTICATE_MESSAGE and returns
+// the server side of the session it establishes
+func (s *ntlmServer) verify(msg []byte) *ntlmSession {
+	field := func(i int) []byte {
+		length := binary.LittleEndian.Uint16(msg[12+8*i:])
+		offset := binary.LittleEndian.Uint32(msg[16+8*i:])
+		return msg[offset : offset+uint32(length)]
+	}
+	raw, _ := base64.StdEncoding.DecodeString(recordedChallenge)
+	challenge, _ := parseNTLMChallenge(raw)
+	nt := field(1)
+	key := ntowfv2(string(utf16Decode(field(3))), string(utf16Decode(field(2))), s.password)
+	proof := hmacMD5(key, challenge.ServerChallenge, nt[16:])
+	if !bytes.Equal(proof, nt[:16]) {
+		return nil
+	}
+
+	flags := binary.LittleEndian.Uint32(msg[60:])
+	sessionKey := make([]byte, 16)
+	cipher, _ := rc4.NewCipher(hmacMD5(key, proof))
+	cipher.XORKeyStream(sessionKey, field(5))
+	session, _ := newNTLMSession(flags, sessionKey)
+	return serverSide(session)
+}
+
+// serverSide turns a client session into its server counterpart
+func serverSide(session *ntlmSession) *ntlmSession {
+	session.clientSigningKey, session.serverSigningKey = session.serverSigningKey, session.clientSigningKey
+	session.clientSeal, session.serverSeal = session.serverSeal, session.clientSeal
+	return session
+}
+
+func utf16Decode(b []byte) []rune {
+	var runes []rune
+	for i := 0; i+1 < len(b); i += 2 {
+		runes = append(runes, rune(binary.LittleEndian.Uint16(b[i:])))
+	}
+	return runes
+}
+
+func (NTLMSuite) TestHttpNTLMAuth(c *gc.C) {
+	server := newNTLMServer(c, "Passw0rd", true)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint:     server.URL,
+		AuthType:     "NTLMAuth",
+		Username:     `WINHOST\Administrator`,
+		Passwd:       "Passw0rd",
+		HttpInsecure: true,
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := req.HttpNTLMAuth([]byte("trololol"))
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, "trololol")
+	}
+	// the authenticated connection is reused by later requests
+	c.Assert(server.handshakes, gc.Equals, 1)
+	c.Assert(server.raw, gc.DeepEquals, []string{"trololol", "trololol"})
+}
+
+func (NTLMSuite) TestHttpNTLMAuthWrapTransport(c *gc.C) {
+	server := newNTLMServer(c, "Passw0rd", true)
+	defer server.Close()
+
+	var requests int
+	req := SoapRequest{
+		Endpoint:     server.URL,
+		AuthType:     "NTLMAuth",
+		Username:     `WINHOST\Administrator`,
+		Passwd:       "Passw0rd",
+		HttpInsecure: true,
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				requests++
+				return rt.RoundTrip(r)
+			})
+		},
+	}
+	resp, err := req.HttpNTLMAuth([]byte("trololol"))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	// the negotiate and authenticate messages go through the wrapper too
+	c.Assert(requests, gc.Equals, 2)
+}
+
+func (NTLMSuite) TestHttpNTLMAuthEncrypted(c *gc.C) {
+	server := newNTLMServer(c, "Passw0rd", false)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "NTLMAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "Passw0rd",
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := req.HttpNTLMAuth([]byte("trololol"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(resp.StatusCode, gc.Equals, 200)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(body), gc.Equals, "trololol")
+	}
+	c.Assert(server.handshakes, gc.Equals, 1)
+	c.Assert(server.raw, gc.HasLen, 3)
+	for _, raw := range server.raw {
+		c.Assert(strings.Contains(raw, "trololol"), gc.Equals, false)
+	}
+}
+
+// MS-NLMP 4.2.4.4 GSS_WrapEx example with extended session security
+func (NTLMSuite) TestNTLMSessionWrap(c *gc.C) {
+	session, err := newNTLMSession(0xe28a8233&ntlmClientFlags, vectorSessionKey)
+	c.Assert(err, gc.IsNil)
+	signature, sealed, err := session.Wrap(utf16le("Plaintext"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(sealed, gc.DeepEquals, unhex("54e50165bf1936dc996020c1811b0f06fb5f"))
+	c.Assert(signature, gc.DeepEquals, unhex("010000007fb38ec5c55d497600000000"))
+}
+
+func (NTLMSuite) TestNTLMSessionRoundTrip(c *gc.C) {
+	client, err := newNTLMSession(0xe28a8233&ntlmClientFlags, vectorSessionKey)
+	c.Assert(err, gc.IsNil)
+	server, err := newNTLMSession(0xe28a8233&ntlmClientFlags, vectorSessionKey)
+	c.Assert(err, gc.IsNil)
+	server = serverSide(server)
+
+	for _, msg := range []string{"such great", "needs more lines"} {
+		body, err := encryptMessage(client, spnegoEncryptedProtocol, []byte(msg))
+		c.Assert(err, gc.IsNil)
+		plain, err := decryptMessage(server, body)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(plain), gc.Equals, msg)
+
+		body, err = encryptMessage(server, spnegoEncryptedProtocol, []byte(msg))
+		c.Assert(err, gc.IsNil)
+		plain, err = decryptMessage(client, body)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(plain), gc.Equals, msg)
+	}
+
+	// a replayed message fails the sequence number check
+	body, err := encryptMessage(server, spnegoEncryptedProtocol, []byte("such great"))
+	c.Assert(err, gc.IsNil)
+	_, err = decryptMessage(client, body)
+	c.Assert(err, gc.IsNil)
+	_, err = decryptMessage(client, body)
+	c.Assert(err, gc.ErrorMatches, "Invalid NTLM message signature")
+}
+
+func (NTLMSuite) TestHttpNTLMAuthWrongPassword(c *gc.C) {
+	server := newNTLMServer(c, "Passw0rd", false)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "NTLMAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "wrong",
+	}
+	resp, err := req.HttpNTLMAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "Remote host returned error status code: 401")
+}
+
+func (NTLMSuite) TestHttpNTLMAuthNoChallenge(c *gc.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="WSMAN"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "NTLMAuth",
+		Username: "Administrator",
+		Passwd:   "Passw0rd",
+	}
+	resp, err := req.HttpNTLMAuth([]byte("trololol"))
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "NTLM handshake failed: remote host returned status code 401 without a challenge")
+}
+
+func (NTLMSuite) TestSendMessageNTLMAuthNeedsCredentials(c *gc.C) {
+	req := SoapRequest{AuthType: "NTLMAuth"}
+
+	resp, err := req.SendMessage(&Envelope{})
+	c.Assert(resp, gc.IsNil)
+	c.Assert(err, gc.ErrorMatches, "AuthType NTLMAuth needs Username and Passwd")
+}
@@ -0,0 +1,250 @@
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf16"
+)
+
+// powershellArgs start PowerShell for an -EncodedCommand, without the
+// profile of the user nor prompts
+const powershellArgs = "-NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand "
+
+// maxCommandLine is the longest command line cmd.exe accepts
+const maxCommandLine = 8191
+
+// scriptChunkSize is the size of the pieces of a long script uploaded by
+// each command, small enough for the command, encoded twice, to fit in
+// maxCommandLine
+const scriptChunkSize = 2048
+
+// utf8BOM makes Windows PowerShell read an uploaded script as UTF-8
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// scriptEnd is appended to an uploaded script to record whether its last
+// statement succeeded. It is left unset when the script called exit.
+const scriptEnd = "\n$global:WinRMScriptSucceeded = $?"
+
+// runScript runs the uploaded script at the PowerShell expression path and
+// deletes it. Like an -EncodedCommand, it exits with the code the script
+// passed to exit, or else with 0 or 1 depending on whether the script
+// succeeded.
+func runScript(path string) string {
+	return fmt.Sprintf("$path = %s\n$global:WinRMScriptSucceeded = $null\n"+
+		"try { & $path; $ok = $? } finally { Remove-Item -Force -ErrorAction SilentlyContinue $path }\n"+
+		"if ($null -eq $global:WinRMScriptSucceeded) { exit $LASTEXITCODE }\n"+
+		"exit $(if ($ok -and $global:WinRMScriptSucceeded) { 0 } else { 1 })", path)
+}
+
+// EncodePowerShell encodes script for the -EncodedCommand parameter of
+// PowerShell, as base64 of its UTF-16LE form
+func EncodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	b := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], unit)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// powershellParams returns the command running script in shellID
+func powershellParams(shellID, script string) CmdParams {
+	return CmdParams{ShellID: shellID, Cmd: "powershell", Args: powershellArgs + EncodePowerShell(script)}
+}
+
+// fitsCommandLine reports whether params makes a short enough command line
+func fitsCommandLine(params CmdParams) bool {
+	return len(params.Cmd)+1+len(params.Args) <= maxCommandLine
+}
+
+// RunPowerShell runs script in a shell of its own and returns its
+// output and exit code, like RemoteShell.RunPowerShell
+func (c *Client) RunPowerShell(ctx context.Context, script string) (string, string, int, error) {
+	shell, err := c.NewShell(ctx, ShellParams{})
+	if err != nil {
+		return "", "", 0, err
+	}
+	stdout, stderr, exitCode, err := shell.RunPowerShell(ctx, script)
+	closeCtx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+	defer cancel()
+	if closeErr := shell.Close(closeCtx); err == nil {
+		err = closeErr
+	}
+	return stdout, stderr, exitCode, err
+}
+
+// RunPowerShell runs script with PowerShell and returns its output and
+// exit code. The script is passed as an -EncodedCommand, so it needs no
+// escaping. Scripts too long for a command line are uploaded in chunks
+// to a temporary .ps1 file, which is deleted once run.
+func (shell *RemoteShell) RunPowerShell(ctx context.Context, script string) (string, string, int, error) {
+	params := powershellParams(shell.ID, script)
+	if fitsCommandLine(params) {
+		return shell.output(ctx, params)
+	}
+
+	uuid, err := Uuid()
+	if err != nil {
+		return "", "", 0, err
+	}
+	path := fmt.Sprintf("(Join-Path $env:TEMP 'winrm-%s.ps1')", uuid)
+	if err := shell.uploadScript(ctx, path, script); err != nil {
+		// remove what was uploaded, independently of ctx
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+		defer cancel()
+		shell.output(cleanupCtx, powershellParams(shell.ID, fmt.Sprintf("Remove-Item -Force -ErrorAction SilentlyContinue %s", path)))
+		return "", "", 0, err
+	}
+	return shell.output(ctx, powershellParams(shell.ID, runScript(path)))
+}
+
+// uploadScript writes script, UTF-8 encoded, to the file at the
+// PowerShell expression path
+func (shell *RemoteShell) uploadScript(ctx context.Context, path, script string) error {
+	content := append(append(append([]byte(nil), utf8BOM...), script...), scriptEnd...)
+	for i := 0; i < len(content); i += scriptChunkSize {
+		end := i + scriptChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		mode := "Append"
+		if i == 0 {
+			mode = "Create"
+		}
+		chunk := fmt.Sprintf("$bytes = [Convert]::FromBase64String('%s')\n$file = [IO.File]::Open(%s, '%s')\ntry { $file.Write($bytes, 0, $bytes.Length) } finally { $file.Close() }",
+			base64.StdEncoding.EncodeToString(content[i:end]), path, mode)
+		_, stderr, exitCode, err := shell.output(ctx, powershellParams(shell.ID, chunk))
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return errors.New(fmt.Sprintf("Uploading the script failed with exit code %d: %s", exitCode, stderr))
+		}
+	}
+	return nil
+}
+
+// output runs params in the shell and returns its output and exit code
+func (shell *RemoteShell) output(ctx context.Context, params CmdParams) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := shell.Execute(ctx, params, nil, &stdout, &stderr)
+	return stdout.String(), stderr.String(), exitCode, err
+}
+
+// jsonDepth is how deep ConvertTo-Json serializes the result of
+// RunPowerShellJSON
+const jsonDepth = 10
+
+// PowerShellError is returned when a PowerShell script failed
+type PowerShellError struct {
+	ExitCode int
+	// Streams are the decoded error streams of the script
+	Streams *PowerShellStreams
+}
+
+func (e *PowerShellError) Error() string {
+	msg := fmt.Sprintf("PowerShell failed with exit code %d", e.ExitCode)
+	if e.Streams != nil {
+		if len(e.Streams.Errors) > 0 {
+			return msg + ": " + e.Streams.Errors[0].Message
+		}
+		if e.Streams.Text != "" {
+			return msg + ": " + e.Streams.Text
+		}
+	}
+	return msg
+}
+
+// RunPowerShellJSON runs the PowerShell expression in a shell of its own
+// and unmarshals its result into v, like RemoteShell.RunPowerShellJSON
+func (c *Client) RunPowerShellJSON(ctx context.Context, expression string, v interface{}) error {
+	script, marker, err := jsonScript(expression)
+	if err != nil {
+		return err
+	}
+	stdout, stderr, exitCode, err := c.RunPowerShell(ctx, script)
+	if err != nil {
+		return err
+	}
+	return decodeJSONResult(stdout, stderr, exitCode, marker, v)
+}
+
+// RunPowerShellJSON runs the PowerShell expression, which may be several
+// statements, and unmarshals the objects it outputs into v, serialized
+// with ConvertTo-Json. A v pointing to a slice receives every object, any
+// other v the only one; nothing is stored when there is no object. Any
+// error stops the script and is returned as a *PowerShellError.
+func (shell *RemoteShell) RunPowerShellJSON(ctx context.Context, expression string, v interface{}) error {
+	script, marker, err := jsonScript(expression)
+	if err != nil {
+		return err
+	}
+	stdout, stderr, exitCode, err := shell.RunPowerShell(ctx, script)
+	if err != nil {
+		return err
+	}
+	return decodeJSONResult(stdout, stderr, exitCode, marker, v)
+}
+
+// jsonScript wraps expression to print its result as JSON between two
+// markers, apart from anything else the script prints
+func jsonScript(expression string) (string, string, error) {
+	uuid, err := Uuid()
+	if err != nil {
+		return "", "", err
+	}
+	marker := "<<winrm-json-" + uuid + ">>"
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+$ProgressPreference = 'SilentlyContinue'
+$result = @(
+%s
+)
+$json = ConvertTo-Json -InputObject $result -Depth %d -Compress
+[Console]::OutputEncoding = New-Object System.Text.UTF8Encoding $false
+[Console]::Out.Write('%s' + $json + '%s')
+[Console]::Out.Flush()`, expression, jsonDepth, marker, marker)
+	return script, marker, nil
+}
+
+// decodeJSONResult unmarshals into v the JSON array printed between the
+// markers by a jsonScript
+func decodeJSONResult(stdout, stderr string, exitCode int, marker string, v interface{}) error {
+	start := strings.Index(stdout, marker)
+	end := strings.LastIndex(stdout, marker)
+	if exitCode != 0 || start < 0 || end <= start {
+		streams, err := DecodeCLIXML(stderr)
+		if err != nil {
+			streams = &PowerShellStreams{Text: stderr}
+		}
+		if exitCode == 0 && len(streams.Errors) == 0 {
+			return errors.New("PowerShell did not return a JSON result")
+		}
+		return &PowerShellError{ExitCode: exitCode, Streams: streams}
+	}
+
+	var items []json.RawMessage
+	result := []byte(stdout[start+len(marker) : end])
+	if err := json.Unmarshal(result, &items); err != nil {
+		return err
+	}
+	// ConvertTo-Json turns a single object into an array of it with
+	// -InputObject, which is unwrapped unless v is a slice
+	kind := reflect.Indirect(reflect.ValueOf(v)).Kind()
+	if kind == reflect.Slice || kind == reflect.Array {
+		return json.Unmarshal(result, v)
+	}
+	switch len(items) {
+	case 0:
+		return nil
+	case 1:
+		return json.Unmarshal(items[0], v)
+	}
+	return errors.New(fmt.Sprintf("PowerShell returned %d objects for a single value", len(items)))
+}
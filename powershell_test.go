@@ -0,0 +1,288 @@
+package winrm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	gc "launchpad.net/gocheck"
+)
+
+type PowerShellSuite struct{}
+
+var _ = gc.Suite(PowerShellSuite{})
+
+var encodedCommand = regexp.MustCompile(`<rsp:Command>powershell</rsp:Command>\s*<rsp:Arguments>-NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand ([A-Za-z0-9+/=]+)</rsp:Arguments>`)
+
+// decodeCommand returns the script run by a Command request body
+func decodeCommand(c *gc.C, body string) string {
+	match := encodedCommand.FindStringSubmatch(body)
+	c.Assert(match, gc.NotNil)
+	b, err := base64.StdEncoding.DecodeString(match[1])
+	c.Assert(err, gc.IsNil)
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func (PowerShellSuite) TestEncodePowerShell(c *gc.C) {
+	c.Assert(EncodePowerShell("dir"), gc.Equals, "ZABpAHIA")
+	// characters outside the BMP take a surrogate pair
+	c.Assert(EncodePowerShell("'€ 😀'"), gc.Equals, "JwCsICAAPdgA3icA")
+}
+
+func (PowerShellSuite) TestRunPowerShell(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	script := `Get-ChildItem "C:\Program Files" | Where-Object { $_.Name -like '*%^&*' }`
+	stdout, stderr, exitCode, err := client.RunPowerShell(context.Background(), script)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stdout, gc.Equals, "such great")
+	c.Assert(stderr, gc.Equals, "")
+	c.Assert(exitCode, gc.Equals, 3)
+
+	c.Assert(server.seen(), gc.DeepEquals, []string{"transfer/Create", "shell/Command", "shell/Receive", "transfer/Delete"})
+	c.Assert(decodeCommand(c, server.received("shell/Command")[0]), gc.Equals, script)
+}
+
+func (PowerShellSuite) TestRunPowerShellLongScript(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	script := "# ünïcödé\n" + strings.Repeat("Write-Output 'line'\n", 500)
+	chunks := (len(utf8BOM) + len(script) + len(scriptEnd) + scriptChunkSize - 1) / scriptChunkSize
+	for i := 0; i < chunks; i++ {
+		server.replies["shell/Receive"] = append(server.replies["shell/Receive"], receiveDone("", "", 0))
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	shell, err := client.NewShell(context.Background(), ShellParams{})
+	c.Assert(err, gc.IsNil)
+	_, _, exitCode, err := shell.RunPowerShell(context.Background(), script)
+	c.Assert(err, gc.IsNil)
+	c.Assert(exitCode, gc.Equals, 3)
+
+	commands := server.received("shell/Command")
+	c.Assert(commands, gc.HasLen, chunks+1)
+	uploadChunk := regexp.MustCompile(`^\$bytes = \[Convert\]::FromBase64String\('([^']*)'\)\n\$file = \[IO.File\]::Open\(\(Join-Path \$env:TEMP '(winrm-[0-9a-f-]+\.ps1)'\), '(Create|Append)'\)`)
+	var uploaded []byte
+	var name string
+	for i, body := range commands[:chunks] {
+		match := uploadChunk.FindStringSubmatch(decodeCommand(c, body))
+		c.Assert(match, gc.NotNil)
+		if i == 0 {
+			name = match[2]
+			c.Assert(match[3], gc.Equals, "Create")
+		} else {
+			c.Assert(match[2], gc.Equals, name)
+			c.Assert(match[3], gc.Equals, "Append")
+		}
+		b, err := base64.StdEncoding.DecodeString(match[1])
+		c.Assert(err, gc.IsNil)
+		uploaded = append(uploaded, b...)
+	}
+	c.Assert(string(uploaded), gc.Equals, string(utf8BOM)+script+scriptEnd)
+
+	run := decodeCommand(c, commands[chunks])
+	c.Assert(run, gc.Equals, runScript("(Join-Path $env:TEMP '"+name+"')"))
+	for _, body := range commands {
+		match := encodedCommand.FindStringSubmatch(body)
+		c.Assert(len("powershell ")+len(powershellArgs)+len(match[1]) <= maxCommandLine, gc.Equals, true)
+	}
+}
+
+func (PowerShellSuite) TestRunPowerShellLongScriptExitCode(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	script := strings.Repeat("#", maxCommandLine) + "\nWrite-Error 'failed'"
+	chunks := (len(utf8BOM) + len(script) + len(scriptEnd) + scriptChunkSize - 1) / scriptChunkSize
+	for i := 0; i < chunks; i++ {
+		server.replies["shell/Receive"] = append(server.replies["shell/Receive"], receiveDone("", "", 0))
+	}
+	server.replies["shell/Receive"] = append(server.replies["shell/Receive"], receiveDone("", "failed", 1))
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	_, stderr, exitCode, err := client.RunPowerShell(context.Background(), script)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stderr, gc.Equals, "failed")
+	c.Assert(exitCode, gc.Equals, 1)
+
+	commands := server.received("shell/Command")
+	c.Assert(commands, gc.HasLen, chunks+1)
+	run := decodeCommand(c, commands[chunks])
+	c.Assert(run, gc.Matches, `(?s).*try \{ & \$path; \$ok = \$\? \}.*`)
+	c.Assert(run, gc.Matches, `(?s).*if \(\$null -eq \$global:WinRMScriptSucceeded\) \{ exit \$LASTEXITCODE \}\nexit \$\(if \(\$ok -and \$global:WinRMScriptSucceeded\) \{ 0 \} else \{ 1 \}\)$`)
+}
+
+// TestRunScriptExitCode runs the wrapper of uploaded scripts with pwsh,
+// when it is on the PATH, and checks that it exits as an -EncodedCommand
+// would
+func (PowerShellSuite) TestRunScriptExitCode(c *gc.C) {
+	pwsh, err := exec.LookPath("pwsh")
+	if err != nil {
+		c.Skip("pwsh is not on the PATH")
+	}
+	for _, t := range []struct {
+		script   string
+		exitCode int
+	}{
+		{"'fine'", 0},
+		{"exit 7", 7},
+		{"if ($true) { exit 0 }\nWrite-Error 'not reached'", 0},
+		{"Get-Item -LiteralPath 'does not exist'", 1},
+		{"Get-Item -LiteralPath 'does not exist'\n'recovered'", 0},
+		{"& pwsh -NoProfile -Command 'exit 3'\n'ran'", 0},
+	} {
+		file, err := ioutil.TempFile(c.MkDir(), "script*.ps1")
+		c.Assert(err, gc.IsNil)
+		_, err = file.WriteString(t.script + scriptEnd)
+		c.Assert(err, gc.IsNil)
+		c.Assert(file.Close(), gc.IsNil)
+
+		path, err := QuotePowerShell(file.Name())
+		c.Assert(err, gc.IsNil)
+		err = exec.Command(pwsh, "-NoProfile", "-NonInteractive", "-EncodedCommand", EncodePowerShell(runScript(path))).Run()
+		exitCode := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else {
+			c.Assert(err, gc.IsNil)
+		}
+		c.Assert(exitCode, gc.Equals, t.exitCode, gc.Commentf("%s", t.script))
+		_, err = os.Stat(file.Name())
+		c.Assert(os.IsNotExist(err), gc.Equals, true)
+	}
+}
+
+func (PowerShellSuite) TestRunPowerShellUploadFails(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	_, _, _, err = client.RunPowerShell(context.Background(), strings.Repeat("#", maxCommandLine))
+	c.Assert(err, gc.ErrorMatches, "Uploading the script failed with exit code 3: ")
+
+	commands := server.received("shell/Command")
+	c.Assert(commands, gc.HasLen, 2)
+	c.Assert(decodeCommand(c, commands[1]), gc.Matches, `Remove-Item -Force -ErrorAction SilentlyContinue \(Join-Path \$env:TEMP 'winrm-.*\.ps1'\)`)
+	c.Assert(server.received("transfer/Delete"), gc.HasLen, 1)
+}
+
+var jsonMarker = regexp.MustCompile(`<<winrm-json-[0-9a-f-]+>>`)
+
+// newJSONServer answers every PowerShell command with output, in which
+// MARKER stands for the marker of the JSON result
+func newJSONServer(c *gc.C, output, stderr string, exitCode int) *fakeWinRM {
+	server := newFakeWinRM()
+	server.hook = func(action string) {
+		if action != "shell/Command" {
+			return
+		}
+		commands := server.received("shell/Command")
+		marker := jsonMarker.FindString(decodeCommand(c, commands[len(commands)-1]))
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		server.replies["shell/Receive"] = []string{receiveDone(strings.Replace(output, "MARKER", marker, -1), stderr, exitCode)}
+	}
+	return server
+}
+
+type service struct {
+	Name   string
+	Status int
+}
+
+func (PowerShellSuite) TestRunPowerShellJSON(c *gc.C) {
+	server := newJSONServer(c, "WARNING: stray host output\r\nMARKER[{\"Name\":\"WinRM\",\"Status\":4}]MARKER\r\n", "", 0)
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+
+	// a single object is unwrapped, unless a slice is asked for
+	var svc service
+	c.Assert(client.RunPowerShellJSON(ctx, "Get-Service WinRM | Select-Object Name, Status", &svc), gc.IsNil)
+	c.Assert(svc, gc.DeepEquals, service{Name: "WinRM", Status: 4})
+	var services []service
+	c.Assert(client.RunPowerShellJSON(ctx, "Get-Service WinRM | Select-Object Name, Status", &services), gc.IsNil)
+	c.Assert(services, gc.DeepEquals, []service{{Name: "WinRM", Status: 4}})
+
+	script := decodeCommand(c, server.received("shell/Command")[0])
+	c.Assert(script, gc.Matches, `(?s)\$ErrorActionPreference = 'Stop'.*\$result = @\(\nGet-Service WinRM \| Select-Object Name, Status\n\).*ConvertTo-Json -InputObject \$result -Depth 10 -Compress.*`)
+}
+
+func (PowerShellSuite) TestRunPowerShellJSONMany(c *gc.C) {
+	server := newJSONServer(c, "MARKER[\"a\",\"b\"]MARKER", "", 0)
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	shell, err := client.NewShell(context.Background(), ShellParams{})
+	c.Assert(err, gc.IsNil)
+	defer shell.Close(context.Background())
+
+	var names []string
+	c.Assert(shell.RunPowerShellJSON(context.Background(), "'a'; 'b'", &names), gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"a", "b"})
+	var name string
+	err = shell.RunPowerShellJSON(context.Background(), "'a'; 'b'", &name)
+	c.Assert(err, gc.ErrorMatches, "PowerShell returned 2 objects for a single value")
+}
+
+func (PowerShellSuite) TestRunPowerShellJSONEmpty(c *gc.C) {
+	server := newJSONServer(c, "MARKER[]MARKER", "", 0)
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	svc := service{Name: "unchanged"}
+	c.Assert(client.RunPowerShellJSON(context.Background(), "Get-Service | Where-Object { $false }", &svc), gc.IsNil)
+	c.Assert(svc.Name, gc.Equals, "unchanged")
+}
+
+func (PowerShellSuite) TestRunPowerShellJSONError(c *gc.C) {
+	stderr, err := ioutil.ReadFile("testdata/clixml/errors.txt")
+	c.Assert(err, gc.IsNil)
+	server := newJSONServer(c, "", string(stderr), 1)
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	var svc service
+	err = client.RunPowerShellJSON(context.Background(), `Get-Item C:\missing`, &svc)
+	c.Assert(err, gc.ErrorMatches, `PowerShell failed with exit code 1: Get-Item : Cannot find path 'C:\\missing' because it does not exist\.`)
+	psErr, ok := err.(*PowerShellError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(psErr.Streams.Errors, gc.HasLen, 2)
+	c.Assert(psErr.Streams.Errors[0].FullyQualifiedErrorId, gc.Equals, "PathNotFound,Microsoft.PowerShell.Commands.GetItemCommand")
+}
+
+func (PowerShellSuite) TestPowerShellErrorNoStreams(c *gc.C) {
+	err := &PowerShellError{ExitCode: 1}
+	c.Assert(err.Error(), gc.Equals, "PowerShell failed with exit code 1")
+}
+
+func (PowerShellSuite) TestRunPowerShellJSONNoResult(c *gc.C) {
+	server := newJSONServer(c, "[1]", "", 0)
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	var n int
+	err = client.RunPowerShellJSON(context.Background(), "1", &n)
+	c.Assert(err, gc.ErrorMatches, "PowerShell did not return a JSON result")
+}
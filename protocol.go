@@ -1,10 +1,16 @@
 package winrm
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/xml"
-	// "io/ioutil"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
 )
 
 type Envelope struct {
@@ -21,6 +27,13 @@ type ShellParams struct {
 	EnvVars    *Environment
 	NoProfile  bool
 	Codepage   string
+	// IdleTimeOut is how long the shell may stay without any command
+	// before the server deletes it. Zero leaves the server default.
+	IdleTimeOut time.Duration
+	// Locale and DataLocale are the languages of the messages and of
+	// the formatted data of the shell, en-US by default
+	Locale     string
+	DataLocale string
 }
 
 type HeaderParams struct {
@@ -30,11 +43,54 @@ type HeaderParams struct {
 	MessageID   string
 }
 
+// MaxEnvelopeSize is the largest SOAP envelope, in bytes, that the server
+// is asked to accept or send, unless SoapRequest.MaxEnvelopeSize is set
+const MaxEnvelopeSize = 153600
+
+// minEnvelopeSize is the smallest MaxEnvelopeSize WS-Management allows
+const minEnvelopeSize = 8192
+
+// stdinChunkSize is the largest stdin chunk that, once base64 encoded,
+// still fits in a Send envelope of maxEnvelopeSize
+func stdinChunkSize(maxEnvelopeSize int) int {
+	return (maxEnvelopeSize - 4096) / 4 * 3
+}
+
+// Signal codes that can be sent to a running command
+const (
+	// SignalCtrlC interrupts the command like a Ctrl-C pressed in its
+	// console
+	SignalCtrlC = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/ctrl_c"
+	// SignalCtrlBreak sends the command a Ctrl-Break
+	SignalCtrlBreak = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/ctrl_break"
+	// SignalTerminate terminates the command
+	SignalTerminate = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+)
+
+// signalCode expands the short names ctrl_c, ctrl_break and terminate into
+// their signal code. Other codes are returned unchanged.
+func signalCode(code string) string {
+	switch code {
+	case "ctrl_c":
+		return SignalCtrlC
+	case "ctrl_break":
+		return SignalCtrlBreak
+	case "terminate":
+		return SignalTerminate
+	}
+	return code
+}
+
 type CmdParams struct {
 	ShellID string
 	Cmd     string
 	Args    string
 	Timeout string
+	// SkipCmdShell starts Cmd directly instead of through cmd.exe, which
+	// would otherwise interpret characters such as ^, %, & and quotes
+	// in Args. Args is then split by the rules of CommandLineToArgvW;
+	// see JoinArgs.
+	SkipCmdShell bool
 }
 
 func (envelope *Envelope) RunCommand(shellParams ShellParams, params CmdParams, soap SoapRequest) (string, string, int, error) {
@@ -82,7 +138,7 @@ func (envelope *Envelope) GetSoapHeaders(params HeaderParams) error {
 			Lang:           "en-US",
 		},
 		MaxEnvelopeSize: &ValueMustUnderstand{
-			Value: "153600",
+			Value: strconv.Itoa(MaxEnvelopeSize),
 			Attr:  "true",
 		},
 	}
@@ -123,6 +179,29 @@ func (envelope *Envelope) GetSoapHeaders(params HeaderParams) error {
 
 // TODO: Do a soap request and return ShellID
 func (envelope *Envelope) GetShell(params ShellParams, soap SoapRequest) (string, error) {
+	envelope.shellEnvelope(params)
+
+	// response from WinRM
+	resp, err := soap.SendMessage(envelope)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respObj, err := readResponse(resp.Body, envelope)
+	if err != nil {
+		return "", err
+	}
+	if respObj.Body == nil || respObj.Body.Shell == nil {
+		return "", errors.New("Invalid server response")
+	}
+	shellID := respObj.Body.Shell.ShellId
+
+	return shellID, err
+}
+
+// shellEnvelope fills envelope with a Create request for a new cmd shell
+func (envelope *Envelope) shellEnvelope(params ShellParams) {
 	HeadParams := HeaderParams{
 		ResourceURI: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd",
 		Action:      "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create",
@@ -133,14 +212,29 @@ func (envelope *Envelope) GetShell(params ShellParams, soap SoapRequest) (string
 	if params.Codepage == "" {
 		params.Codepage = "437"
 	}
+	noProfile := "FALSE"
+	if params.NoProfile {
+		noProfile = "TRUE"
+	}
 	envelope.Headers.OptionSet = &OptionSet{
 		[]ValueName{
-			ValueName{Attr: "WINRS_NOPROFILE", Value: "FALSE"},
+			ValueName{Attr: "WINRS_NOPROFILE", Value: noProfile},
 			ValueName{Attr: "WINRS_CODEPAGE", Value: params.Codepage},
 		},
 	}
+	if params.Locale != "" {
+		envelope.Headers.Locale.Lang = params.Locale
+	}
+	if params.DataLocale != "" {
+		envelope.Headers.DataLocale.Lang = params.DataLocale
+	}
 	var Body BodyStruct = BodyStruct{}
-	var ShellVars Shell = Shell{}
+	var ShellVars Shell = Shell{
+		WorkingDirectory: params.WorkingDir,
+	}
+	if params.IdleTimeOut > 0 {
+		ShellVars.IdleTimeOut = formatDuration(params.IdleTimeOut)
+	}
 
 	if params.IStream == "" {
 		ShellVars.InputStreams = "stdin"
@@ -158,43 +252,53 @@ func (envelope *Envelope) GetShell(params ShellParams, soap SoapRequest) (string
 		ShellVars.Environment = params.EnvVars
 	}
 
-	// send request to WinRm
 	Body.Shell = &ShellVars
 	envelope.Body = &Body
 	envelope.EnvelopeAttrs = Namespaces
+}
 
-	// response from WinRM
+func (envelope *Envelope) SendCommand(params CmdParams, soap SoapRequest) (string, error) {
+	if err := envelope.commandEnvelope(params); err != nil {
+		return "", err
+	}
+
+	// fmt.Printf("%s\n", output)
 	resp, err := soap.SendMessage(envelope)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	respObj, err := GetObjectFromXML(resp.Body)
-	//fmt.Printf("%v\n", respObj)
+	respObj, err := readResponse(resp.Body, envelope)
 	if err != nil {
 		return "", err
 	}
-	shellID := respObj.Body.Shell.ShellId
-
-	return shellID, err
+	if respObj.Body == nil || respObj.Body.CommandResponse == nil {
+		return "", errors.New("Invalid server response")
+	}
+	return respObj.Body.CommandResponse.CommandId, nil
 }
 
-func (envelope *Envelope) SendCommand(params CmdParams, soap SoapRequest) (string, error) {
+// commandEnvelope fills envelope with a Command request starting params.Cmd
+func (envelope *Envelope) commandEnvelope(params CmdParams) error {
 	HeadParams := HeaderParams{
 		ResourceURI: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd",
 		Action:      "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command",
 	}
 	if params.ShellID == "" {
-		return "", errors.New("Invalid ShellId")
+		return errors.New("Invalid ShellId")
 	}
 	HeadParams.ShellID = params.ShellID
 	envelope.GetSoapHeaders(HeadParams)
 
+	skipCmdShell := "FALSE"
+	if params.SkipCmdShell {
+		skipCmdShell = "TRUE"
+	}
 	envelope.Headers.OptionSet = &OptionSet{
 		[]ValueName{
 			ValueName{Attr: "WINRS_CONSOLEMODE_STDIN", Value: "TRUE"},
-			ValueName{Attr: "WINRS_SKIP_CMD_SHELL", Value: "FALSE"},
+			ValueName{Attr: "WINRS_SKIP_CMD_SHELL", Value: skipCmdShell},
 		},
 	}
 
@@ -203,11 +307,10 @@ func (envelope *Envelope) SendCommand(params CmdParams, soap SoapRequest) (strin
 	} else {
 		envelope.Headers.OperationTimeout = params.Timeout
 	}
-	// var Body BodyStruct = BodyStruct{}
 
 	envelope.EnvelopeAttrs = Namespaces
 	if params.Cmd == "" {
-		return "", errors.New("Invalid command")
+		return errors.New("Invalid command")
 	}
 	envelope.Body = &BodyStruct{
 		CommandLine: &Command{
@@ -218,24 +321,66 @@ func (envelope *Envelope) SendCommand(params CmdParams, soap SoapRequest) (strin
 	if params.Args != "" {
 		envelope.Body.CommandLine.Arguments = params.Args
 	}
+	return nil
+}
 
-	// fmt.Printf("%s\n", output)
-	resp, err := soap.SendMessage(envelope)
+func (envelope *Envelope) GetCommandOutput(shellID, commandID string, soap SoapRequest) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	retCode, err := receiveOutput(context.Background(), &soap, envelope, shellID, commandID, &stdout, &stderr)
 	if err != nil {
-		return "", err
+		return "", "", 0, err
 	}
-	defer resp.Body.Close()
+	return stdout.String(), stderr.String(), retCode, nil
+}
+
+// receiveOutput keeps sending Receive requests for commandID until its
+// CommandState is Done, copying output to stdout and stderr as it arrives.
+// A Receive that timed out on the server only means there was no output yet.
+func receiveOutput(ctx context.Context, soap *SoapRequest, envelope *Envelope, shellID, commandID string, stdout, stderr io.Writer) (int, error) {
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	for {
+		envelope.receiveEnvelope(shellID, commandID)
+		resp, err := soap.sendMessage(ctx, envelope)
+		if errors.Is(err, ErrOperationTimeout) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		respObj, err := readResponse(resp.Body, envelope)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+		if respObj.Body == nil || respObj.Body.ReceiveResponse == nil {
+			return 0, errors.New("Invalid server response")
+		}
+		done, retCode, err := writeStreams(respObj.Body.ReceiveResponse, stdout, stderr)
+		if err != nil || done {
+			return retCode, err
+		}
+	}
+}
 
-	respObj, err := GetObjectFromXML(resp.Body)
+// readResponse decodes the response to the request envelope
+func readResponse(body io.Reader, envelope *Envelope) (ResponseEnvelope, error) {
+	response, err := GetObjectFromXML(body)
 	if err != nil {
-		return "", err
+		return response, err
 	}
-	// contents, _ := ioutil.ReadAll(resp.Body)
-	// fmt.Printf("REQ:%s\n\nRESP:%s\n\nSHELL:%s\n\n", output, contents, shellID)
-	return respObj.Body.CommandResponse.CommandId, nil
+	if err := response.checkRelatesTo(envelope); err != nil {
+		return ResponseEnvelope{}, err
+	}
+	return response, nil
 }
 
-func (envelope *Envelope) GetCommandOutput(shellID, commandID string, soap SoapRequest) (string, string, int, error) {
+// receiveEnvelope fills envelope with a Receive request for the output of commandID
+func (envelope *Envelope) receiveEnvelope(shellID, commandID string) {
 	HeadParams := HeaderParams{
 		ResourceURI: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd",
 		Action:      "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive",
@@ -251,19 +396,66 @@ func (envelope *Envelope) GetCommandOutput(shellID, commandID string, soap SoapR
 			},
 		},
 	}
+}
 
-	resp, err := soap.SendMessage(envelope)
-	if err != nil {
-		return "", "", 0, err
+// keepAliveEnvelope fills envelope with a Receive request that only
+// resets the idle timer of the shell
+func (envelope *Envelope) keepAliveEnvelope(shellID string) {
+	envelope.receiveEnvelope(shellID, "")
+	envelope.Headers.OptionSet = &OptionSet{
+		[]ValueName{
+			ValueName{Attr: "WSMAN_CMDSHELL_OPTION_KEEPALIVE", Value: "TRUE"},
+		},
 	}
-	defer resp.Body.Close()
+	envelope.Headers.OperationTimeout = "PT1S"
+	envelope.Body.Receive.DesiredStream.Value = "stdout"
+}
 
-	stdout, stderr, retCode, err := ParseCommandOutput(resp.Body)
-	// fmt.Printf("%s\n", output)
-	return stdout, stderr, retCode, nil
+// sendEnvelope fills envelope with a Send request delivering data to the
+// stdin of commandID. end marks the last chunk of input.
+func (envelope *Envelope) sendEnvelope(shellID, commandID string, data []byte, end bool) {
+	HeadParams := HeaderParams{
+		ResourceURI: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd",
+		Action:      "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Send",
+		ShellID:     shellID,
+	}
+	envelope.GetSoapHeaders(HeadParams)
+	envelope.EnvelopeAttrs = Namespaces
+	stream := SendStream{
+		Value:     base64.StdEncoding.EncodeToString(data),
+		Name:      "stdin",
+		CommandId: commandID,
+	}
+	if end {
+		stream.End = "true"
+	}
+	envelope.Body = &BodyStruct{
+		Send: &Send{Stream: stream},
+	}
 }
 
 func (envelope *Envelope) CleanupShell(shellID, commandID string, soap SoapRequest) error {
+	return envelope.SignalCommand(shellID, commandID, SignalTerminate, soap)
+}
+
+// SignalCommand sends the signal code, or its short name such as ctrl_c,
+// to commandID
+func (envelope *Envelope) SignalCommand(shellID, commandID, code string, soap SoapRequest) error {
+	envelope.signalEnvelope(shellID, commandID, code)
+
+	resp, err := soap.SendMessage(envelope)
+	if err != nil {
+		return err
+	}
+	// the body is read so that the connection can be reused
+	defer drainBody(resp)
+	// contents, err2 := ioutil.ReadAll(resp.Body)
+	// fmt.Printf("%s --> %s", contents, err2)
+	return nil
+}
+
+// signalEnvelope fills envelope with a Signal request sending code to commandID
+func (envelope *Envelope) signalEnvelope(shellID, commandID, code string) {
 	HeadParams := HeaderParams{
 		ResourceURI: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd",
 		Action:      "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal",
@@ -273,23 +465,28 @@ func (envelope *Envelope) CleanupShell(shellID, commandID string, soap SoapReque
 	envelope.EnvelopeAttrs = Namespaces
 	sig := Signal{
 		Attr: commandID,
-		Code: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate",
+		Code: signalCode(code),
 	}
 	envelope.Body = &BodyStruct{
 		Signal: &sig,
 	}
+}
+
+func (envelope *Envelope) CloseShell(shellID string, soap SoapRequest) error {
+	envelope.deleteEnvelope(shellID)
 
 	resp, err := soap.SendMessage(envelope)
+	// contents, err := ioutil.ReadAll(resp.Body)
+	// fmt.Printf("REQ:%s\n\nRESP:%s\n\nSHELL:%s\n\n", output, contents, shellID)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	// contents, err2 := ioutil.ReadAll(resp.Body)
-	// fmt.Printf("%s --> %s", contents, err2)
+	defer drainBody(resp)
 	return nil
 }
 
-func (envelope *Envelope) CloseShell(shellID string, soap SoapRequest) error {
+// deleteEnvelope fills envelope with a Delete request for shellID
+func (envelope *Envelope) deleteEnvelope(shellID string) {
 	HeadParams := HeaderParams{
 		ResourceURI: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd",
 		Action:      "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete",
@@ -300,13 +497,4 @@ func (envelope *Envelope) CloseShell(shellID string, soap SoapRequest) error {
 	envelope.EnvelopeAttrs = Namespaces
 	envelope.GetSoapHeaders(HeadParams)
 	envelope.Body = &Body
-
-	resp, err := soap.SendMessage(envelope)
-	// contents, err := ioutil.ReadAll(resp.Body)
-	// fmt.Printf("REQ:%s\n\nRESP:%s\n\nSHELL:%s\n\n", output, contents, shellID)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	return nil
 }
@@ -1,6 +1,12 @@
 package winrm
 
-import gc "launchpad.net/gocheck"
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+
+	gc "launchpad.net/gocheck"
+)
 
 type ProtocolSuite struct{}
 
@@ -73,6 +79,48 @@ func (ProtocolSuite) TestGetShellMakeEnvelope(c *gc.C) {
 	c.Assert(env.Body.Shell, gc.DeepEquals, &Shell{InputStreams: expparams.IStream, OutputStreams: expparams.OStream, Environment: expparams.EnvVars})
 }
 
+// tests if every ShellParams field is set in the Create request
+func (ProtocolSuite) TestShellEnvelopeParams(c *gc.C) {
+	env := Envelope{}
+	env.shellEnvelope(ShellParams{
+		WorkingDir:  `C:\Temp`,
+		NoProfile:   true,
+		Codepage:    "65001",
+		IdleTimeOut: 10 * time.Minute,
+		Locale:      "de-DE",
+		DataLocale:  "fr-FR",
+	})
+	c.Assert(env.Headers.OptionSet.Option, gc.DeepEquals, []ValueName{
+		ValueName{Attr: "WINRS_NOPROFILE", Value: "TRUE"},
+		ValueName{Attr: "WINRS_CODEPAGE", Value: "65001"},
+	})
+	c.Assert(env.Headers.Locale.Lang, gc.Equals, "de-DE")
+	c.Assert(env.Headers.DataLocale.Lang, gc.Equals, "fr-FR")
+	c.Assert(env.Body.Shell.WorkingDirectory, gc.Equals, `C:\Temp`)
+	c.Assert(env.Body.Shell.IdleTimeOut, gc.Equals, "PT600.000S")
+
+	env = Envelope{}
+	env.shellEnvelope(ShellParams{})
+	c.Assert(env.Headers.OptionSet.Option[0], gc.DeepEquals, ValueName{Attr: "WINRS_NOPROFILE", Value: "FALSE"})
+	c.Assert(env.Headers.Locale.Lang, gc.Equals, "en-US")
+	c.Assert(env.Headers.DataLocale.Lang, gc.Equals, "en-US")
+	output, err := xml.Marshal(env)
+	c.Assert(err, gc.IsNil)
+	c.Assert(strings.Contains(string(output), "WorkingDirectory"), gc.Equals, false)
+	c.Assert(strings.Contains(string(output), "IdleTimeOut"), gc.Equals, false)
+}
+
+// tests if SkipCmdShell is sent as the WINRS_SKIP_CMD_SHELL option
+func (ProtocolSuite) TestCommandEnvelopeSkipCmdShell(c *gc.C) {
+	env := Envelope{}
+	c.Assert(env.commandEnvelope(CmdParams{ShellID: "Something", Cmd: "whoami"}), gc.IsNil)
+	c.Assert(env.Headers.OptionSet.Option[1], gc.DeepEquals, ValueName{Attr: "WINRS_SKIP_CMD_SHELL", Value: "FALSE"})
+
+	env = Envelope{}
+	c.Assert(env.commandEnvelope(CmdParams{ShellID: "Something", Cmd: "whoami", SkipCmdShell: true}), gc.IsNil)
+	c.Assert(env.Headers.OptionSet.Option[1], gc.DeepEquals, ValueName{Attr: "WINRS_SKIP_CMD_SHELL", Value: "TRUE"})
+}
+
 // tests if missing ShellID parameter is signaled by SendCommand
 func (ProtocolSuite) TestSendCommandNoShellId(c *gc.C) {
 	env := Envelope{}
@@ -177,3 +225,17 @@ func (ProtocolSuite) TestCloseShellMakeEnvelope(c *gc.C) {
 	c.Assert(env.Headers.ReplyTo, gc.DeepEquals, expenv.Headers.ReplyTo)
 	c.Assert(env.Headers.DataLocale, gc.DeepEquals, expenv.Headers.DataLocale)
 }
+
+// tests if Envelope attributes succesfully updated by sendEnvelope
+func (ProtocolSuite) TestSendEnvelope(c *gc.C) {
+	env := Envelope{}
+
+	env.sendEnvelope("shell", "command", []byte("such great"), true)
+	c.Assert(env.EnvelopeAttrs, gc.Equals, Namespaces)
+	c.Assert(env.Headers.Action.Value, gc.Equals, "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Send")
+	c.Assert(env.Headers.SelectorSet, gc.DeepEquals, &Selector{ValueName{"shell", "ShellId"}})
+	c.Assert(env.Body.Send, gc.DeepEquals, &Send{SendStream{Value: "c3VjaCBncmVhdA==", Name: "stdin", CommandId: "command", End: "true"}})
+
+	env.sendEnvelope("shell", "command", []byte("such great"), false)
+	c.Assert(env.Body.Send.Stream.End, gc.Equals, "")
+}
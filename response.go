@@ -5,88 +5,193 @@ import (
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 )
 
+// CommandStateDone is reported in a ReceiveResponse once a command has
+// exited and all of its output was delivered
+const CommandStateDone = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+
+// Response elements are matched by namespace URI, as the prefixes are
+// chosen by the server:
+//
+//	s    http://www.w3.org/2003/05/soap-envelope
+//	a    http://schemas.xmlsoap.org/ws/2004/08/addressing
+//	x    http://schemas.xmlsoap.org/ws/2004/09/transfer
+//	n    http://schemas.xmlsoap.org/ws/2004/09/enumeration
+//	w    http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd
+//	rsp  http://schemas.microsoft.com/wbem/wsman/1/windows/shell
+//	f    http://schemas.microsoft.com/wbem/wsman/1/wsmanfault
+
 type ResponseSelector struct {
-	Value string `xml:",innerxml"`
+	Value string `xml:",chardata"`
 	Name  string `xml:"Name,attr"`
 }
 
 type ResponseSelectorSet struct {
-	Selector *ResponseSelector `xml"w:Selector"`
+	Selector *ResponseSelector `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd Selector"`
 }
 
 type ReferenceParameters struct {
-	ResourceURI string               `xml"w:ResourceURI"`
-	SelectorSet *ResponseSelectorSet `xml"w:SelectorSet"`
+	ResourceURI string               `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd ResourceURI"`
+	SelectorSet *ResponseSelectorSet `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd SelectorSet"`
 }
 
+// ResourceCreated is the endpoint reference of a shell in a Create response
 type ResourceCreated struct {
-	Address             string               `xml"a:Address"`
-	ReferenceParameters *ReferenceParameters `xml"a:ReferenceParameters"`
+	Address             string               `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing Address"`
+	ReferenceParameters *ReferenceParameters `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing ReferenceParameters"`
 }
 
 type ResponseHeader struct {
-	Action    string `xml"a:Action"`
-	MessageID string `xml"a:MessageID"`
-	To        string `xml"a:To"`
-	RelatesTo string `xml"a:RelatesTo"`
+	Action    string `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing Action"`
+	MessageID string `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing MessageID"`
+	To        string `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing To"`
+	RelatesTo string `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing RelatesTo"`
 }
 
+// CommandResponse is the body of a Command response
 type CommandResponse struct {
-	CommandId string `xml"rsp:CommandId"`
+	CommandId string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandId"`
 }
 
+// ResponseShell describes a shell in Create, Get and Enumerate responses
 type ResponseShell struct {
-	// xmlnsRsp        string  `xml:"xmlns:rsp,attr"`
-	ShellId         string `xml"rsp:ShellId`
-	ResourceUri     string `xml"rsp:ResourceUri"`
-	Owner           string `xml"rsp:Owner"`
-	ClientIP        string `xml"rsp:ClientIP"`
-	IdleTimeOut     string `xml"rsp:IdleTimeOut"`
-	InputStreams    string `xml"rsp:InputStreams"`
-	OutputStreams   string `xml"rsp:OutputStreams"`
-	ShellRunTime    string `xml"rsp:OutputStreams"`
-	ShellInactivity string `xml"rsp:OutputStreams"`
+	ShellId         string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ShellId"`
+	Name            string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Name"`
+	ResourceUri     string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ResourceUri"`
+	Owner           string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Owner"`
+	ClientIP        string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ClientIP"`
+	ProcessId       string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ProcessId"`
+	IdleTimeOut     string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell IdleTimeOut"`
+	InputStreams    string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell InputStreams"`
+	OutputStreams   string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell OutputStreams"`
+	MaxIdleTimeOut  string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell MaxIdleTimeOut"`
+	Locale          string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Locale"`
+	DataLocale      string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell DataLocale"`
+	CompressionMode string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CompressionMode"`
+	ProfileLoaded   string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ProfileLoaded"`
+	Encoding        string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Encoding"`
+	BufferMode      string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell BufferMode"`
+	State           string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell State"`
+	ShellRunTime    string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ShellRunTime"`
+	ShellInactivity string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ShellInactivity"`
 }
 
 type ResponseStream struct {
-	Value string `xml:",innerxml"`
-	Name  string `xml:"Name,attr"`
-	End   string `xml:"End,attr"`
+	Value     string `xml:",chardata"`
+	Name      string `xml:"Name,attr"`
+	CommandId string `xml:"CommandId,attr"`
+	End       string `xml:"End,attr"`
 }
 
 type ResponseCommandState struct {
-	ExitCode  int    `xml"rsp:ExitCode"`
+	ExitCode  int    `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ExitCode"`
 	CommandId string `xml:"CommandId,attr"`
 	State     string `xml:"State,attr"`
 }
 
+// ReceiveResponse is the body of a Receive response
 type ReceiveResponse struct {
-	Stream       []ResponseStream      `xml"rsp:Stream"`
-	CommandState *ResponseCommandState `xml"rsp:CommandState"`
+	Stream       []ResponseStream      `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Stream"`
+	CommandState *ResponseCommandState `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandState"`
+}
+
+// SendResponse and SignalResponse are the empty bodies of Send and Signal
+// responses
+type SendResponse struct{}
+
+type SignalResponse struct{}
+
+// EnumerationItems holds the items of an Enumerate or Pull response. Raw
+// keeps the items of resources other than shells.
+type EnumerationItems struct {
+	Shell []ResponseShell `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Shell"`
+	Raw   string          `xml:",innerxml"`
+}
+
+// EndOfSequence marks the last items of an enumeration
+type EndOfSequence struct{}
+
+// EnumerateResponse is the body of an Enumerate response. Optimized
+// enumerations carry their first items in the wsman namespace.
+type EnumerateResponse struct {
+	EnumerationContext string            `xml:"http://schemas.xmlsoap.org/ws/2004/09/enumeration EnumerationContext"`
+	Items              *EnumerationItems `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd Items"`
+	EndOfSequence      *EndOfSequence    `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd EndOfSequence"`
+}
+
+// PullResponse is the body of a Pull response
+type PullResponse struct {
+	EnumerationContext string            `xml:"http://schemas.xmlsoap.org/ws/2004/09/enumeration EnumerationContext"`
+	Items              *EnumerationItems `xml:"http://schemas.xmlsoap.org/ws/2004/09/enumeration Items"`
+	EndOfSequence      *EndOfSequence    `xml:"http://schemas.xmlsoap.org/ws/2004/09/enumeration EndOfSequence"`
+}
+
+type FaultCode struct {
+	Value   string     `xml:"http://www.w3.org/2003/05/soap-envelope Value"`
+	Subcode *FaultCode `xml:"http://www.w3.org/2003/05/soap-envelope Subcode"`
+}
+
+type FaultReason struct {
+	Text string `xml:"http://www.w3.org/2003/05/soap-envelope Text"`
+}
+
+type FaultMessage struct {
+	Text          string `xml:",chardata"`
+	ProviderFault string `xml:"http://schemas.microsoft.com/wbem/wsman/1/wsmanfault ProviderFault"`
 }
 
+// ResponseWSManFault is the WSManFault detail of a fault
+type ResponseWSManFault struct {
+	Code    string        `xml:"Code,attr"`
+	Machine string        `xml:"Machine,attr"`
+	Message *FaultMessage `xml:"http://schemas.microsoft.com/wbem/wsman/1/wsmanfault Message"`
+}
+
+type FaultDetail struct {
+	WSManFault *ResponseWSManFault `xml:"http://schemas.microsoft.com/wbem/wsman/1/wsmanfault WSManFault"`
+}
+
+// ResponseFault is the body of a response reporting an error
+type ResponseFault struct {
+	Code   *FaultCode   `xml:"http://www.w3.org/2003/05/soap-envelope Code"`
+	Reason *FaultReason `xml:"http://www.w3.org/2003/05/soap-envelope Reason"`
+	Detail *FaultDetail `xml:"http://www.w3.org/2003/05/soap-envelope Detail"`
+}
+
+// ResponseBody holds the body of any response. Delete responses have an
+// empty body.
 type ResponseBody struct {
-	CommandResponse *CommandResponse `xml"rsp:CommandResponse"`
-	ResourceCreated *ResourceCreated `xml"x:ResourceCreated"`
-	Shell           *ResponseShell   `xml"rsp:Shell"`
-	ReceiveResponse *ReceiveResponse `xml"rsp:ReceiveResponse"`
+	CommandResponse   *CommandResponse   `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandResponse"`
+	ResourceCreated   *ResourceCreated   `xml:"http://schemas.xmlsoap.org/ws/2004/09/transfer ResourceCreated"`
+	Shell             *ResponseShell     `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Shell"`
+	ReceiveResponse   *ReceiveResponse   `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ReceiveResponse"`
+	SendResponse      *SendResponse      `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell SendResponse"`
+	SignalResponse    *SignalResponse    `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell SignalResponse"`
+	EnumerateResponse *EnumerateResponse `xml:"http://schemas.xmlsoap.org/ws/2004/09/enumeration EnumerateResponse"`
+	PullResponse      *PullResponse      `xml:"http://schemas.xmlsoap.org/ws/2004/09/enumeration PullResponse"`
+	Fault             *ResponseFault     `xml:"http://www.w3.org/2003/05/soap-envelope Fault"`
 }
 
 type ResponseEnvelope struct {
-	XMLName xml.Name `xml"s:Envelope"`
-	// xmlnsS      string       `xml"xmlns:s,attr"`
-	// xmlnsA      string       `xml"xmlns:a,attr"`
-	// xmlnsX      string       `xml"xmlns:x,attr"`
-	// xmlnsW      string       `xml"xmlns:w,attr"`
-	// xmlnsRsp    string       `xml"xmlns:rsp,attr"`
-	// xmlnsP      string       `xml"xmlns:p,attr"`
-	// xmlnsLang   string       `xml"xmlns:lang,attr"`
-	Header *ResponseHeader `xml"s:Header"`
-	Body   *ResponseBody   `xml"s:Body"`
+	XMLName xml.Name        `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+	Header  *ResponseHeader `xml:"http://www.w3.org/2003/05/soap-envelope Header"`
+	Body    *ResponseBody   `xml:"http://www.w3.org/2003/05/soap-envelope Body"`
+}
+
+// checkRelatesTo verifies that response answers the request envelope
+func (response *ResponseEnvelope) checkRelatesTo(envelope *Envelope) error {
+	var relatesTo string
+	if response.Header != nil {
+		relatesTo = response.Header.RelatesTo
+	}
+	if envelope.Headers == nil || relatesTo != envelope.Headers.MessageID {
+		return errors.New(fmt.Sprintf("Invalid server response: RelatesTo %q does not match the request MessageID", relatesTo))
+	}
+	return nil
 }
 
 func GetObjectFromXML(XMLinput io.Reader) (ResponseEnvelope, error) {
@@ -138,3 +243,31 @@ func ParseCommandOutput(XMLinput io.Reader) (stdout, stderr string, exitcode int
 	err = nil
 	return
 }
+
+// writeStreams decodes the streams of a single ReceiveResponse into stdout
+// and stderr. It reports whether the command is done and, if so, its exit code.
+func writeStreams(response *ReceiveResponse, stdout, stderr io.Writer) (bool, int, error) {
+	for _, value := range response.Stream {
+		if value.Value == "" {
+			continue
+		}
+		tmp, err := base64.StdEncoding.DecodeString(value.Value)
+		if err != nil {
+			return false, 0, errors.New("Error decoding " + value.Name)
+		}
+		switch value.Name {
+		case "stdout":
+			_, err = stdout.Write(tmp)
+		case "stderr":
+			_, err = stderr.Write(tmp)
+		}
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	state := response.CommandState
+	if state == nil || state.State != CommandStateDone {
+		return false, 0, nil
+	}
+	return true, state.ExitCode, nil
+}
@@ -2,8 +2,13 @@ package winrm
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"flag"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 
 	gc "launchpad.net/gocheck"
 )
@@ -12,6 +17,10 @@ type responseSuite struct{}
 
 var _ = gc.Suite(responseSuite{})
 
+func (responseSuite) TearDownTest(c *gc.C) {
+	parseXML = GetObjectFromXML
+}
+
 func (responseSuite) TestGetFromXML(c *gc.C) {
 	xmlin := `<s:Envelope xml:lang="en-US" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:x="http://schemas.xmlsoap.org/ws/2004/09/transfer" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell" xmlns:p="http://schemas.microsoft.com/wbem/wsman/1/wsman.xsd"><s:Header><a:Action>http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandResponse</a:Action><a:MessageID>uuid:EC452E31-2872-4921-8C0C-C76398695407</a:MessageID><a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To><a:RelatesTo>uuid:7261e275-6d36-a627-8de0-e382e3a3cc5a</a:RelatesTo></s:Header><s:Body><rsp:CommandResponse><rsp:CommandId>6D0A426F-4B4A-44F8-AF20-C35365258FEB</rsp:CommandId></rsp:CommandResponse></s:Body></s:Envelope>`
 	res, err := GetObjectFromXML(bytes.NewBufferString(xmlin))
@@ -34,6 +43,69 @@ func (responseSuite) TestGerFromXMLError(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "Invalid server response")
 }
 
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files of testdata/responses")
+
+// TestGoldenResponses decodes the responses of testdata/responses and
+// compares the result with the .golden file next to each response. They
+// are written by hand after the examples of MS-WSMV and the layout of
+// Windows Server responses, not captured from a live host, so a real
+// capture disagreeing with them should replace them.
+func (responseSuite) TestGoldenResponses(c *gc.C) {
+	files, err := filepath.Glob("testdata/responses/*.xml")
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.Not(gc.HasLen), 0)
+	for _, file := range files {
+		xmlin, err := ioutil.ReadFile(file)
+		c.Assert(err, gc.IsNil)
+		res, err := GetObjectFromXML(bytes.NewReader(xmlin))
+		c.Assert(err, gc.IsNil, gc.Commentf(file))
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "\t")
+		c.Assert(encoder.Encode(res), gc.IsNil)
+		decoded := buf.Bytes()
+
+		golden := strings.TrimSuffix(file, ".xml") + ".golden"
+		if *updateGolden {
+			c.Assert(ioutil.WriteFile(golden, decoded, 0644), gc.IsNil)
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(decoded), gc.Equals, string(expected), gc.Commentf(file))
+	}
+}
+
+// the namespace URIs identify the elements, whatever their prefixes
+func (responseSuite) TestGetFromXMLPrefixes(c *gc.C) {
+	xmlin := `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing"><env:Header><wsa:RelatesTo>uuid:1</wsa:RelatesTo></env:Header><env:Body><CommandResponse xmlns="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><CommandId>6D0A426F-4B4A-44F8-AF20-C35365258FEB</CommandId></CommandResponse></env:Body></env:Envelope>`
+	res, err := GetObjectFromXML(bytes.NewBufferString(xmlin))
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Header.RelatesTo, gc.Equals, "uuid:1")
+	c.Assert(res.Body.CommandResponse.CommandId, gc.Equals, "6D0A426F-4B4A-44F8-AF20-C35365258FEB")
+
+	// elements of another namespace are ignored
+	xmlin = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:rsp="urn:other"><s:Body><rsp:CommandResponse><rsp:CommandId>1</rsp:CommandId></rsp:CommandResponse></s:Body></s:Envelope>`
+	res, err = GetObjectFromXML(bytes.NewBufferString(xmlin))
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Body.CommandResponse, gc.IsNil)
+}
+
+func (responseSuite) TestReadResponseRelatesTo(c *gc.C) {
+	xmlin, err := ioutil.ReadFile("testdata/responses/command.xml")
+	c.Assert(err, gc.IsNil)
+	envelope := &Envelope{}
+	envelope.GetSoapHeaders(HeaderParams{MessageID: "uuid:7261e275-6d36-a627-8de0-e382e3a3cc5a"})
+	res, err := readResponse(bytes.NewReader(xmlin), envelope)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Body.CommandResponse.CommandId, gc.Equals, "6D0A426F-4B4A-44F8-AF20-C35365258FEB")
+
+	envelope.GetSoapHeaders(HeaderParams{MessageID: "uuid:00000000-0000-0000-0000-000000000000"})
+	_, err = readResponse(bytes.NewReader(xmlin), envelope)
+	c.Assert(err, gc.ErrorMatches, `Invalid server response: RelatesTo "uuid:7261e275-6d36-a627-8de0-e382e3a3cc5a" does not match the request MessageID`)
+}
+
 func MockStdOut(XMLinput io.Reader) (ResponseEnvelope, error) {
 	a := make([]ResponseStream, 3)
 	a[0] = ResponseStream{Value: "c3VjaCBncmVhdA==", Name: "stdout", End: ""}
@@ -168,3 +240,45 @@ func (responseSuite) TestInvalidStdErrParseCommandOutput(c *gc.C) {
 	c.Assert(stderr, gc.Equals, "")
 	c.Assert(exitcode, gc.Equals, 0)
 }
+
+func (responseSuite) TestWriteStreamsRunning(c *gc.C) {
+	var stdout, stderr bytes.Buffer
+	response := &ReceiveResponse{
+		Stream: []ResponseStream{
+			ResponseStream{Value: "c3VjaCBncmVhdA0K", Name: "stdout"},
+			ResponseStream{Value: "bmVlZHMgbW9yZSBsaW5lcw==", Name: "stderr"},
+		},
+		CommandState: &ResponseCommandState{State: "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Running"},
+	}
+	done, exitcode, err := writeStreams(response, &stdout, &stderr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(done, gc.Equals, false)
+	c.Assert(exitcode, gc.Equals, 0)
+	c.Assert(stdout.String(), gc.Equals, "such great\r\n")
+	c.Assert(stderr.String(), gc.Equals, "needs more lines")
+}
+
+func (responseSuite) TestWriteStreamsDone(c *gc.C) {
+	var stdout, stderr bytes.Buffer
+	response := &ReceiveResponse{
+		Stream: []ResponseStream{
+			ResponseStream{Value: "", Name: "stdout", End: "true"},
+			ResponseStream{Value: "c3VjaCBncmVhdA==", Name: "stdout", End: "true"},
+		},
+		CommandState: &ResponseCommandState{State: CommandStateDone, ExitCode: 666},
+	}
+	done, exitcode, err := writeStreams(response, &stdout, &stderr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(done, gc.Equals, true)
+	c.Assert(exitcode, gc.Equals, 666)
+	c.Assert(stdout.String(), gc.Equals, "such great")
+}
+
+func (responseSuite) TestWriteStreamsInvalid(c *gc.C) {
+	var stdout, stderr bytes.Buffer
+	response := &ReceiveResponse{
+		Stream: []ResponseStream{ResponseStream{Value: "0", Name: "stderr"}},
+	}
+	_, _, err := writeStreams(response, &stdout, &stderr)
+	c.Assert(err, gc.ErrorMatches, "Error decoding stderr")
+}
@@ -0,0 +1,221 @@
+package winrm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RemoteShell is a shell kept open to run many commands, one after the
+// other or concurrently, saving the creation and deletion of a shell for
+// each of them. A RemoteShell must be closed once done with.
+type RemoteShell struct {
+	client *Client
+	// ID is the ShellId of the shell
+	ID string
+	// Owner is the user the shell runs as and ClientIP the address the
+	// server saw it created from
+	Owner    string
+	ClientIP string
+	// IdleTimeOut is how long the shell may stay without any command
+	// before the server deletes it
+	IdleTimeOut time.Duration
+	// ShellRunTime and ShellInactivity are the time the shell had been
+	// alive and idle for when it was created
+	ShellRunTime    time.Duration
+	ShellInactivity time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	// stop is closed to end the keep-alive started by StartKeepAlive
+	stop chan struct{}
+}
+
+// defaultKeepAlive is the keep-alive interval used when the server did
+// not report the idle timeout of the shell
+const defaultKeepAlive = time.Minute
+
+// NewShell creates a remote shell with params and returns it open
+func (c *Client) NewShell(ctx context.Context, params ShellParams) (*RemoteShell, error) {
+	created, err := c.createShell(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	shell := &RemoteShell{client: c, ID: created.ShellId}
+	shell.update(created)
+	return shell, nil
+}
+
+// update copies the properties of the shell reported by the server
+func (shell *RemoteShell) update(info *ResponseShell) {
+	shell.Owner = info.Owner
+	shell.ClientIP = info.ClientIP
+	// durations the server omitted or that do not parse are left unset
+	shell.IdleTimeOut, _ = parseDuration(info.IdleTimeOut)
+	shell.ShellRunTime, _ = parseDuration(info.ShellRunTime)
+	shell.ShellInactivity, _ = parseDuration(info.ShellInactivity)
+}
+
+// check fails once the shell is closed
+func (shell *RemoteShell) check() error {
+	shell.mu.Lock()
+	defer shell.mu.Unlock()
+	if shell.closed {
+		return errors.New("Shell is closed")
+	}
+	return nil
+}
+
+// Run starts params.Cmd in the shell and returns the CommandId of the new
+// command. params.ShellID is ignored.
+func (shell *RemoteShell) Run(ctx context.Context, params CmdParams) (string, error) {
+	if err := shell.check(); err != nil {
+		return "", err
+	}
+	params.ShellID = shell.ID
+	return shell.client.Run(ctx, params)
+}
+
+// Receive streams the output of commandID like Client.Receive
+func (shell *RemoteShell) Receive(ctx context.Context, commandID string, stdout, stderr io.Writer) (int, error) {
+	if err := shell.check(); err != nil {
+		return 0, err
+	}
+	return shell.client.Receive(ctx, shell.ID, commandID, stdout, stderr)
+}
+
+// Execute runs params.Cmd to completion in the shell like
+// Client.Execute. params.ShellID is ignored.
+func (shell *RemoteShell) Execute(ctx context.Context, params CmdParams, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if err := shell.check(); err != nil {
+		return 0, err
+	}
+	params.ShellID = shell.ID
+	return shell.client.Execute(ctx, params, stdin, stdout, stderr)
+}
+
+// SendInput copies stdin to commandID like Client.SendInput
+func (shell *RemoteShell) SendInput(ctx context.Context, commandID string, stdin io.Reader) error {
+	if err := shell.check(); err != nil {
+		return err
+	}
+	return shell.client.SendInput(ctx, shell.ID, commandID, stdin)
+}
+
+// Signal sends the signal code to commandID like Client.Signal
+func (shell *RemoteShell) Signal(ctx context.Context, commandID, code string) error {
+	if err := shell.check(); err != nil {
+		return err
+	}
+	return shell.client.Signal(ctx, shell.ID, commandID, code)
+}
+
+// KeepAlive resets the idle timer of the shell, which the server would
+// otherwise delete once left without commands for IdleTimeOut
+func (shell *RemoteShell) KeepAlive(ctx context.Context) error {
+	if err := shell.check(); err != nil {
+		return err
+	}
+	envelope := &Envelope{}
+	envelope.keepAliveEnvelope(shell.ID)
+	_, err := shell.client.post(ctx, envelope)
+	// the server holds the request until it times out when no command
+	// has output to send
+	if errors.Is(err, ErrOperationTimeout) {
+		return nil
+	}
+	return err
+}
+
+// StartKeepAlive calls KeepAlive every interval in the background until
+// the shell is closed or found deleted. A zero interval stands for half
+// of IdleTimeOut. Calling StartKeepAlive again does nothing.
+func (shell *RemoteShell) StartKeepAlive(interval time.Duration) {
+	shell.mu.Lock()
+	defer shell.mu.Unlock()
+	if shell.closed || shell.stop != nil {
+		return
+	}
+	if interval <= 0 {
+		interval = shell.IdleTimeOut / 2
+	}
+	if interval <= 0 {
+		interval = defaultKeepAlive
+	}
+	stop := make(chan struct{})
+	shell.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := shell.KeepAlive(ctx)
+			cancel()
+			if errors.Is(err, ErrShellNotFound) {
+				return
+			}
+		}
+	}()
+}
+
+// Close deletes the remote shell and stops its keep-alive. Commands
+// cannot be started once Close was called, even if it failed; closing a
+// shell again does nothing.
+func (shell *RemoteShell) Close(ctx context.Context) error {
+	shell.mu.Lock()
+	if shell.closed {
+		shell.mu.Unlock()
+		return nil
+	}
+	shell.closed = true
+	if shell.stop != nil {
+		close(shell.stop)
+	}
+	shell.mu.Unlock()
+	return shell.client.DeleteShell(ctx, shell.ID)
+}
+
+// formatDuration formats d as an xs:duration in seconds, such as
+// PT7200.000S
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+var xmlDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d*)?)S)?)?$`)
+
+// parseDuration parses an xs:duration made of days, hours, minutes and
+// seconds, such as PT7200.000S or P0DT1H30M0S
+func parseDuration(value string) (time.Duration, error) {
+	match := xmlDuration.FindStringSubmatch(value)
+	if match == nil || value == "P" || value == "PT" {
+		return 0, errors.New(fmt.Sprintf("Invalid duration: %q", value))
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute} {
+		if match[i+1] != "" {
+			n, err := strconv.ParseInt(match[i+1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			d += time.Duration(n) * unit
+		}
+	}
+	if match[4] != "" {
+		seconds, err := strconv.ParseFloat(match[4], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(seconds * float64(time.Second))
+	}
+	return d, nil
+}
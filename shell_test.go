@@ -0,0 +1,188 @@
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	gc "launchpad.net/gocheck"
+)
+
+type ShellSuite struct{}
+
+var _ = gc.Suite(ShellSuite{})
+
+const createdShell = `<rsp:Shell><rsp:ShellId>0C2A5F7E-65A6-4B3D-9C5B-5A2E4F1D8E37</rsp:ShellId><rsp:ResourceUri>http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd</rsp:ResourceUri><rsp:Owner>WINHOST\Administrator</rsp:Owner><rsp:ClientIP>192.168.1.10</rsp:ClientIP><rsp:IdleTimeOut>PT7200.000S</rsp:IdleTimeOut><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams><rsp:ShellRunTime>P0DT0H0M1S</rsp:ShellRunTime><rsp:ShellInactivity>P0DT0H0M0S</rsp:ShellInactivity></rsp:Shell>`
+
+func (ShellSuite) TestNewShell(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["transfer/Create"] = []string{createdShell}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	shell, err := client.NewShell(context.Background(), ShellParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(shell.ID, gc.Equals, "0C2A5F7E-65A6-4B3D-9C5B-5A2E4F1D8E37")
+	c.Assert(shell.Owner, gc.Equals, `WINHOST\Administrator`)
+	c.Assert(shell.ClientIP, gc.Equals, "192.168.1.10")
+	c.Assert(shell.IdleTimeOut, gc.Equals, 2*time.Hour)
+	c.Assert(shell.ShellRunTime, gc.Equals, time.Second)
+	c.Assert(shell.ShellInactivity, gc.Equals, time.Duration(0))
+}
+
+func (ShellSuite) TestShellRunsManyCommands(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+	shell, err := client.NewShell(ctx, ShellParams{})
+	c.Assert(err, gc.IsNil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var stdout bytes.Buffer
+			exitCode, err := shell.Execute(ctx, CmdParams{Cmd: "dir"}, nil, &stdout, nil)
+			if err == nil && (exitCode != 3 || stdout.String() != "such great") {
+				err = errors.New("Unexpected output")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(shell.Close(ctx), gc.IsNil)
+	c.Assert(shell.Close(ctx), gc.IsNil)
+
+	c.Assert(server.received("transfer/Create"), gc.HasLen, 1)
+	c.Assert(server.received("transfer/Delete"), gc.HasLen, 1)
+	commands := server.received("shell/Command")
+	c.Assert(commands, gc.HasLen, 4)
+	for _, body := range commands {
+		c.Assert(body, gc.Matches, `(?s).*<w:Selector Name="ShellId">9731F5BD-E90B-403B-A8DB-010396CEBB4D</w:Selector>.*`)
+	}
+}
+
+func (ShellSuite) TestShellClosed(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+	shell, err := client.NewShell(ctx, ShellParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(shell.Close(ctx), gc.IsNil)
+
+	_, err = shell.Run(ctx, CmdParams{Cmd: "dir"})
+	c.Assert(err, gc.ErrorMatches, "Shell is closed")
+	_, err = shell.Execute(ctx, CmdParams{Cmd: "dir"}, nil, nil, nil)
+	c.Assert(err, gc.ErrorMatches, "Shell is closed")
+	_, err = shell.Receive(ctx, "1", nil, nil)
+	c.Assert(err, gc.ErrorMatches, "Shell is closed")
+	err = shell.SendInput(ctx, "1", strings.NewReader("input"))
+	c.Assert(err, gc.ErrorMatches, "Shell is closed")
+	err = shell.Signal(ctx, "1", SignalCtrlC)
+	c.Assert(err, gc.ErrorMatches, "Shell is closed")
+	c.Assert(server.received("shell/Command"), gc.HasLen, 0)
+	// nothing is sent for the deleted shell
+	seen := server.seen()
+	c.Assert(seen[len(seen)-1], gc.Equals, "transfer/Delete")
+}
+
+func (ShellSuite) TestParseDuration(c *gc.C) {
+	for value, expected := range map[string]time.Duration{
+		"PT7200.000S": 2 * time.Hour,
+		"PT60S":       time.Minute,
+		"P0DT0H0M0S":  0,
+		"P1DT2H3M4S":  26*time.Hour + 3*time.Minute + 4*time.Second,
+		"PT1.5S":      1500 * time.Millisecond,
+		"P2D":         48 * time.Hour,
+	} {
+		d, err := parseDuration(value)
+		c.Assert(err, gc.IsNil)
+		c.Assert(d, gc.Equals, expected, gc.Commentf(value))
+	}
+	for _, value := range []string{"", "P", "PT", "7200", "PT5X"} {
+		_, err := parseDuration(value)
+		c.Assert(err, gc.ErrorMatches, "Invalid duration: .*")
+	}
+}
+
+func (ShellSuite) TestShellKeepAlive(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	server.replies["shell/Receive"] = []string{timedOutFault}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+	shell, err := client.NewShell(ctx, ShellParams{})
+	c.Assert(err, gc.IsNil)
+
+	// the server times out a keep-alive when no command has output
+	c.Assert(shell.KeepAlive(ctx), gc.IsNil)
+	c.Assert(shell.KeepAlive(ctx), gc.IsNil)
+	pings := server.received("shell/Receive")
+	c.Assert(pings, gc.HasLen, 2)
+	c.Assert(pings[0], gc.Matches, `(?s).*<w:Option Name="WSMAN_CMDSHELL_OPTION_KEEPALIVE">TRUE</w:Option>.*`)
+	c.Assert(pings[0], gc.Matches, `(?s).*<rsp:DesiredStream>stdout</rsp:DesiredStream>.*`)
+
+	c.Assert(shell.Close(ctx), gc.IsNil)
+	c.Assert(shell.KeepAlive(ctx), gc.ErrorMatches, "Shell is closed")
+}
+
+func (ShellSuite) TestShellStartKeepAlive(c *gc.C) {
+	server := newFakeWinRM()
+	defer server.Close()
+	pinged := make(chan struct{}, 10)
+	server.hook = func(action string) {
+		if action == "shell/Receive" {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	client, err := NewClient(server.URL, WithBasicAuth("leeroy", "jenkins"))
+	c.Assert(err, gc.IsNil)
+	ctx := context.Background()
+	shell, err := client.NewShell(ctx, ShellParams{})
+	c.Assert(err, gc.IsNil)
+
+	shell.StartKeepAlive(10 * time.Millisecond)
+	shell.StartKeepAlive(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			c.Fatalf("no keep-alive sent")
+		}
+	}
+	c.Assert(shell.Close(ctx), gc.IsNil)
+	n := len(server.received("shell/Receive"))
+	time.Sleep(50 * time.Millisecond)
+	// a keep-alive already in flight when the shell was closed may land
+	c.Assert(len(server.received("shell/Receive")) <= n+1, gc.Equals, true)
+}
+
+func (ShellSuite) TestFormatDuration(c *gc.C) {
+	c.Assert(formatDuration(2*time.Hour), gc.Equals, "PT7200.000S")
+	c.Assert(formatDuration(1500*time.Millisecond), gc.Equals, "PT1.500S")
+	d, err := parseDuration(formatDuration(90 * time.Second))
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, 90*time.Second)
+}
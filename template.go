@@ -0,0 +1,180 @@
+package winrm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// powershellQuotes are the characters PowerShell takes for a single quote,
+// which must all be doubled inside a single quoted string
+const powershellQuotes = "'‘’‚‛"
+
+var powershellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// QuotePowerShell renders v as a PowerShell expression evaluating to the
+// same value, so that it can be put in a script without any risk of
+// injection. Strings, booleans, integers, floats, time.Time (as UTC),
+// byte slices, slices, arrays and maps with string keys are supported,
+// and nil pointers render as $null.
+func QuotePowerShell(v interface{}) (string, error) {
+	return quotePowerShell(reflect.ValueOf(v))
+}
+
+func quotePowerShell(v reflect.Value) (string, error) {
+	if !v.IsValid() {
+		return "$null", nil
+	}
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time).UTC()
+		return fmt.Sprintf("[DateTime]::Parse('%s', [Globalization.CultureInfo]::InvariantCulture, [Globalization.DateTimeStyles]::RoundtripKind)",
+			t.Format("2006-01-02T15:04:05.0000000Z")), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return "$null", nil
+		}
+		return quotePowerShell(v.Elem())
+	case reflect.String:
+		return quotePowerShellString(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			return "$true", nil
+		}
+		return "$false", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n == math.MinInt64 {
+			// negating 9223372036854775808 would give a decimal
+			return fmt.Sprintf("[long]'%d'", n), nil
+		}
+		return strconv.FormatInt(n, 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := v.Uint()
+		if n > math.MaxInt64 {
+			// larger literals would be parsed as a decimal or a double
+			return fmt.Sprintf("[uint64]'%d'", n), nil
+		}
+		return strconv.FormatUint(n, 10), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		switch {
+		case math.IsNaN(f):
+			return "[double]::NaN", nil
+		case math.IsInf(f, 1):
+			return "[double]::PositiveInfinity", nil
+		case math.IsInf(f, -1):
+			return "[double]::NegativeInfinity", nil
+		}
+		return fmt.Sprintf("[double]'%s'", strconv.FormatFloat(f, 'g', -1, v.Type().Bits())), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return "$null", nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return fmt.Sprintf("[Convert]::FromBase64String('%s')", base64.StdEncoding.EncodeToString(b)), nil
+		}
+		items := make([]string, v.Len())
+		for i := range items {
+			item, err := quotePowerShell(v.Index(i))
+			if err != nil {
+				return "", err
+			}
+			items[i] = item
+		}
+		// the unary comma keeps a single item, an array itself, from
+		// being flattened by @()
+		if len(items) == 1 {
+			return "@(," + items[0] + ")", nil
+		}
+		return "@(" + strings.Join(items, ", ") + ")", nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return "", errors.New(fmt.Sprintf("Cannot render %s as a PowerShell literal: keys must be strings", v.Type()))
+		}
+		if v.IsNil() {
+			return "$null", nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		entries := make([]string, len(keys))
+		// the keys of a hashtable are case insensitive
+		seen := make(map[string]bool, len(keys))
+		for i, key := range keys {
+			folded := strings.ToUpper(key.String())
+			if seen[folded] {
+				return "", errors.New(fmt.Sprintf("Cannot render %s as a PowerShell literal: keys differ only by case", v.Type()))
+			}
+			seen[folded] = true
+			name, err := quotePowerShellString(key.String())
+			if err != nil {
+				return "", err
+			}
+			value, err := quotePowerShell(v.MapIndex(key))
+			if err != nil {
+				return "", err
+			}
+			entries[i] = name + " = " + value
+		}
+		return "@{" + strings.Join(entries, "; ") + "}", nil
+	}
+	return "", errors.New(fmt.Sprintf("Cannot render %s as a PowerShell literal", v.Type()))
+}
+
+// quotePowerShellString renders s as a single quoted string, in which
+// nothing but quotes is interpreted
+func quotePowerShellString(s string) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", errors.New("Cannot render a string that is not valid UTF-8 as a PowerShell literal")
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return "", errors.New("Cannot render a string holding a NUL character as a PowerShell literal")
+	}
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		if strings.ContainsRune(powershellQuotes, r) {
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String(), nil
+}
+
+// PowerShellScript prefixes script with a param() block giving each of
+// params as the default value of the parameter of that name, so that
+// script can refer to them as variables, such as $ComputerName. The
+// values are rendered by QuotePowerShell.
+func PowerShellScript(script string, params map[string]interface{}) (string, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if !powershellName.MatchString(name) {
+			return "", errors.New(fmt.Sprintf("Invalid PowerShell parameter name: %q", name))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	declarations := make([]string, len(names))
+	for i, name := range names {
+		value, err := QuotePowerShell(params[name])
+		if err != nil {
+			return "", err
+		}
+		declarations[i] = "$" + name + " = " + value
+	}
+	return "param(" + strings.Join(declarations, ", ") + ")\n" + script, nil
+}
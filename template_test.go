@@ -0,0 +1,285 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	gc "launchpad.net/gocheck"
+)
+
+type TemplateSuite struct{}
+
+var _ = gc.Suite(TemplateSuite{})
+
+func (TemplateSuite) TestQuotePowerShell(c *gc.C) {
+	var nilPtr *string
+	host := "host'; Remove-Item C:\\ -Recurse; '"
+	for _, t := range []struct {
+		value   interface{}
+		literal string
+	}{
+		{nil, `$null`},
+		{nilPtr, `$null`},
+		{"", `''`},
+		{"plain", `'plain'`},
+		{host, `'host''; Remove-Item C:\ -Recurse; '''`},
+		{"$env:PATH `n \"x\" $(whoami)", "'$env:PATH `n \"x\" $(whoami)'"},
+		{"it’s ‘smart’", `'it’’s ‘‘smart’’'`},
+		{&host, `'host''; Remove-Item C:\ -Recurse; '''`},
+		{true, `$true`},
+		{false, `$false`},
+		{42, `42`},
+		{int8(-7), `-7`},
+		{int64(math.MinInt64), `[long]'-9223372036854775808'`},
+		{uint64(math.MaxUint64), `[uint64]'18446744073709551615'`},
+		{1.5, `[double]'1.5'`},
+		{float32(0.1), `[double]'0.1'`},
+		{math.Inf(-1), `[double]::NegativeInfinity`},
+		{[]byte("hi"), `[Convert]::FromBase64String('aGk=')`},
+		{[]string{}, `@()`},
+		{[]string{"a"}, `@(,'a')`},
+		{[]interface{}{"a", 1, []int{2, 3}}, `@('a', 1, @(2, 3))`},
+		{[][]int{{1, 2}}, `@(,@(1, 2))`},
+		{[2]bool{true, false}, `@($true, $false)`},
+		{map[string]int{"b": 2, "a'": 1}, `@{'a''' = 1; 'b' = 2}`},
+		{time.Date(2024, 2, 29, 13, 4, 5, 123456700, time.FixedZone("CET", 3600)),
+			`[DateTime]::Parse('2024-02-29T12:04:05.1234567Z', [Globalization.CultureInfo]::InvariantCulture, [Globalization.DateTimeStyles]::RoundtripKind)`},
+	} {
+		literal, err := QuotePowerShell(t.value)
+		c.Assert(err, gc.IsNil)
+		c.Assert(literal, gc.Equals, t.literal, gc.Commentf("%#v", t.value))
+	}
+}
+
+func (TemplateSuite) TestQuotePowerShellErrors(c *gc.C) {
+	_, err := QuotePowerShell(struct{}{})
+	c.Assert(err, gc.ErrorMatches, "Cannot render struct {} as a PowerShell literal")
+	_, err = QuotePowerShell(map[int]string{})
+	c.Assert(err, gc.ErrorMatches, "Cannot render map\\[int\\]string as a PowerShell literal: keys must be strings")
+	_, err = QuotePowerShell(map[string]int{"Name": 1, "NAME": 2})
+	c.Assert(err, gc.ErrorMatches, "Cannot render map\\[string\\]int as a PowerShell literal: keys differ only by case")
+	_, err = QuotePowerShell("a\x00b")
+	c.Assert(err, gc.ErrorMatches, "Cannot render a string holding a NUL character as a PowerShell literal")
+	_, err = QuotePowerShell([]string{"\xff"})
+	c.Assert(err, gc.ErrorMatches, "Cannot render a string that is not valid UTF-8 as a PowerShell literal")
+}
+
+func (TemplateSuite) TestPowerShellScript(c *gc.C) {
+	script, err := PowerShellScript("Test-Connection $ComputerName -Count $Count", map[string]interface{}{
+		"ComputerName": "web'01",
+		"Count":        2,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(script, gc.Equals, "param($ComputerName = 'web''01', $Count = 2)\nTest-Connection $ComputerName -Count $Count")
+
+	script, err = PowerShellScript("Get-Date", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(script, gc.Equals, "param()\nGet-Date")
+
+	_, err = PowerShellScript("", map[string]interface{}{"x; rm": 1})
+	c.Assert(err, gc.ErrorMatches, `Invalid PowerShell parameter name: "x; rm"`)
+}
+
+// literalParser reads back the strings, integers, booleans, $null, arrays
+// and hashtables rendered by QuotePowerShell, as PowerShell would
+type literalParser struct {
+	s   string
+	pos int
+}
+
+func parsePowerShellLiteral(s string) (interface{}, error) {
+	p := &literalParser{s: s}
+	v, err := p.value()
+	if err == nil && p.pos != len(s) {
+		err = errors.New("trailing characters")
+	}
+	return v, err
+}
+
+func (p *literalParser) consume(prefix string) bool {
+	if strings.HasPrefix(p.s[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (p *literalParser) value() (interface{}, error) {
+	switch {
+	case p.consume("$null"):
+		return nil, nil
+	case p.consume("$true"):
+		return true, nil
+	case p.consume("$false"):
+		return false, nil
+	case p.consume("@("):
+		return p.array()
+	case p.consume("@{"):
+		return p.hashtable()
+	case strings.HasPrefix(p.s[p.pos:], "'"):
+		return p.str()
+	case p.consume("[long]"):
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	}
+	end := p.pos
+	for end < len(p.s) && (p.s[end] == '-' || p.s[end] >= '0' && p.s[end] <= '9') {
+		end++
+	}
+	n, err := strconv.ParseInt(p.s[p.pos:end], 10, 64)
+	p.pos = end
+	return n, err
+}
+
+// str reads a single quoted string, in which two quotes of any kind stand
+// for the second one
+func (p *literalParser) str() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		p.pos += size
+		if !strings.ContainsRune(powershellQuotes, r) {
+			b.WriteRune(r)
+			continue
+		}
+		next, nextSize := utf8.DecodeRuneInString(p.s[p.pos:])
+		if nextSize == 0 || !strings.ContainsRune(powershellQuotes, next) {
+			return b.String(), nil
+		}
+		b.WriteRune(next)
+		p.pos += nextSize
+	}
+	return "", errors.New("unterminated string")
+}
+
+func (p *literalParser) array() ([]interface{}, error) {
+	items := []interface{}{}
+	p.consume(",")
+	for !p.consume(")") {
+		if len(items) > 0 && !p.consume(", ") {
+			return nil, errors.New("expected ,")
+		}
+		item, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *literalParser) hashtable() (map[string]interface{}, error) {
+	table := map[string]interface{}{}
+	for !p.consume("}") {
+		if len(table) > 0 && !p.consume("; ") {
+			return nil, errors.New("expected ;")
+		}
+		key, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(" = ") {
+			return nil, errors.New("expected =")
+		}
+		if table[key], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// pwshRoundTrip has pwsh evaluate literal and returns the value it read,
+// as rendered by ConvertTo-Json
+func pwshRoundTrip(pwsh, literal string) (interface{}, error) {
+	script := "[Console]::OutputEncoding = [Text.UTF8Encoding]::new($false)\n" +
+		"ConvertTo-Json -Compress -Depth 10 -InputObject (" + literal + ")"
+	// the script is passed as base64 UTF-16LE, out of reach of quoting
+	units := utf16.Encode([]rune(script))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(encoded[2*i:], unit)
+	}
+	out, err := exec.Command(pwsh, "-NoProfile", "-NonInteractive", "-EncodedCommand", base64.StdEncoding.EncodeToString(encoded)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(out)
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+// FuzzQuotePowerShell checks that whatever the strings and numbers put in
+// a script, the literal parser of this file, which follows the quoting
+// rules of PowerShell, reads back the very same values. When pwsh is on
+// the PATH, PowerShell itself must read them back too.
+func FuzzQuotePowerShell(f *testing.F) {
+	f.Add("plain", int64(0), true)
+	f.Add("host'; Remove-Item C:\\ -Recurse; '", int64(-1), false)
+	f.Add("‘’‚‛'''", int64(math.MaxInt64), true)
+	f.Add("$(whoami) `n \"@{}\" ,)", int64(math.MinInt64), false)
+	pwsh, _ := exec.LookPath("pwsh")
+	f.Fuzz(func(t *testing.T, s string, n int64, b bool) {
+		value := map[string]interface{}{
+			s:      []interface{}{s, n, b, nil},
+			"list": []interface{}{[]interface{}{s}},
+		}
+		literal, err := QuotePowerShell(value)
+		if !utf8.ValidString(s) || strings.IndexByte(s, 0) >= 0 || strings.EqualFold(s, "list") && s != "list" {
+			if err == nil {
+				t.Fatalf("%q was rendered as %s", s, literal)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("cannot render %q: %v", s, err)
+		}
+		parsed, err := parsePowerShellLiteral(literal)
+		if err != nil {
+			t.Fatalf("cannot parse %s: %v", literal, err)
+		}
+		if !reflect.DeepEqual(parsed, value) {
+			t.Fatalf("%s parsed as %#v", literal, parsed)
+		}
+
+		if pwsh == "" {
+			return
+		}
+		read, err := pwshRoundTrip(pwsh, literal)
+		if err != nil {
+			t.Fatalf("pwsh cannot evaluate %s: %v", literal, err)
+		}
+		expected, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := decodeJSON(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read, want) {
+			t.Fatalf("pwsh read %s as %#v", literal, read)
+		}
+	})
+}
@@ -2,19 +2,49 @@ package winrm
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
-
-	"launchpad.net/gwacl/fork/http"
-	"launchpad.net/gwacl/fork/tls"
+	"sync"
+	"time"
 )
 
+// CertificateCredentials is the client certificate of CertAuth, taken
+// from the first of Certificate, PKCS12, CertPEM and KeyPEM, or the Cert
+// and Key files set
 type CertificateCredentials struct {
+	// Cert and Key are the paths of the PEM certificate and its
+	// unencrypted private key
 	Cert string
 	Key  string
-	CA   string
+	// CA is the path of a PEM bundle of the authorities trusted to sign
+	// the certificate of the server
+	CA string
+	// CertPEM and KeyPEM hold the PEM certificate and its unencrypted
+	// private key
+	CertPEM []byte
+	KeyPEM  []byte
+	// PKCS12 holds a PKCS#12 bundle of the certificate and its key, such
+	// as a .pfx file, protected by PKCS12Password
+	PKCS12         []byte
+	PKCS12Password string
+	// Certificate is the certificate to use as is
+	Certificate *tls.Certificate
+}
+
+// HttpDoer sends HTTP requests, as *http.Client does. It lets requests go
+// through an instrumented client or any other middleware.
+type HttpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
 }
 
 type SoapRequest struct {
@@ -24,23 +54,105 @@ type SoapRequest struct {
 	Passwd       string
 	HttpInsecure bool
 	CertAuth     *CertificateCredentials
-	HttpClient   *http.Client
+	Kerberos     *KerberosCredentials
+	// HttpClient sends the requests of BasicAuth and CertAuth. An
+	// *http.Client without a Transport gets one built by SoapRequest.
+	// Over https, CertAuth, HttpInsecure, Verification and KnownHosts
+	// are applied to a clone of its Transport, which must then be an
+	// *http.Transport, replacing its TLSClientConfig. NTLMAuth,
+	// KerberosAuth, CredSSPAuth and the probe of Auto open connections of
+	// their own, keeping the proxy and dialer of such a Transport.
+	HttpClient HttpDoer
+	// Verification sets how the certificate of an https endpoint is
+	// verified, unless HttpInsecure is set
+	Verification *ServerVerification
+	// KnownHosts, when set, trusts the certificate recorded for the
+	// endpoint in place of its chain, recording it on first use
+	KnownHosts *KnownHosts
+	// WrapTransport, when set, wraps every transport built by
+	// SoapRequest, such as those of the connections authenticated by
+	// NTLMAuth
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+	// MaxIdleConns is how many idle connections to the endpoint are kept
+	// for reuse, defaultMaxIdleConns if zero
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection is kept,
+	// defaultIdleConnTimeout if zero
+	IdleConnTimeout time.Duration
+	// MaxEnvelopeSize is the largest SOAP envelope, in bytes, that the
+	// server is asked to accept or send, the MaxEnvelopeSize constant if
+	// zero. It must not exceed the MaxEnvelopeSizekb of the server.
+	MaxEnvelopeSize int
+
+	// client sends the requests of BasicAuth and CertAuth
+	client *sharedClient
+	// conns keeps the connections authenticated by NTLMAuth,
+	// KerberosAuth and CredSSPAuth
+	conns *connPool
+	// kerberos holds the tickets obtained by KerberosAuth
+	kerberos *kerberosLogin
+	// auto holds the scheme picked by AuthType Auto
+	auto *autoAuth
+}
+
+// envelopeSize returns the MaxEnvelopeSize asked of the server
+func (conf *SoapRequest) envelopeSize() (int, error) {
+	if conf.MaxEnvelopeSize == 0 {
+		return MaxEnvelopeSize, nil
+	}
+	if conf.MaxEnvelopeSize < minEnvelopeSize {
+		return 0, errors.New(fmt.Sprintf("MaxEnvelopeSize must be at least %d bytes", minEnvelopeSize))
+	}
+	return conf.MaxEnvelopeSize, nil
 }
 
 func (conf *SoapRequest) SendMessage(envelope *Envelope) (*http.Response, error) {
+	return conf.sendMessage(context.Background(), envelope)
+}
+
+// sendMessage marshals envelope and posts it to the endpoint. The request
+// is aborted once ctx is done. AuthType Auto picks the authentication
+// scheme from those offered by the endpoint.
+func (conf *SoapRequest) sendMessage(ctx context.Context, envelope *Envelope) (*http.Response, error) {
+	size, err := conf.envelopeSize()
+	if err != nil {
+		return nil, err
+	}
+	if envelope.Headers != nil && envelope.Headers.MaxEnvelopeSize != nil {
+		envelope.Headers.MaxEnvelopeSize.Value = strconv.Itoa(size)
+	}
 	output, err := xml.MarshalIndent(envelope, "  ", "    ")
 	if err != nil {
 		return nil, err
 	}
 
-	if conf.AuthType == "BasicAuth" {
+	authType := conf.AuthType
+	if authType == "Auto" {
+		authType, err = conf.autoAuthType(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if authType == "BasicAuth" {
 		if conf.Username == "" || conf.Passwd == "" {
 			// fmt.Errorf("AuthType BasicAuth needs Username and Passwd")
 			return nil, errors.New("AuthType BasicAuth needs Username and Passwd")
 		}
-		return conf.HttpBasicAuth(output)
-	} else if conf.AuthType == "CertAuth" {
-		return conf.HttpCertAuth(output)
+		return conf.httpBasicAuth(ctx, output)
+	} else if authType == "CertAuth" {
+		return conf.httpCertAuth(ctx, output)
+	} else if authType == "NTLMAuth" {
+		if conf.Username == "" || conf.Passwd == "" {
+			return nil, errors.New("AuthType NTLMAuth needs Username and Passwd")
+		}
+		return conf.httpNTLMAuth(ctx, output)
+	} else if authType == "KerberosAuth" {
+		return conf.httpKerberosAuth(ctx, output)
+	} else if authType == "CredSSPAuth" {
+		if conf.Username == "" || conf.Passwd == "" {
+			return nil, errors.New("AuthType CredSSPAuth needs Username and Passwd")
+		}
+		return conf.httpCredSSPAuth(ctx, output)
 	}
 	return nil, errors.New(fmt.Sprintf("Invalid transport: %s", conf.AuthType))
 }
@@ -53,6 +165,10 @@ func (conf *SoapRequest) GetHttpHeader() map[string]string {
 }
 
 func (conf *SoapRequest) HttpCertAuth(data []byte) (*http.Response, error) {
+	return conf.httpCertAuth(context.Background(), data)
+}
+
+func (conf *SoapRequest) httpCertAuth(ctx context.Context, data []byte) (*http.Response, error) {
 	protocol := strings.Split(conf.Endpoint, ":")
 	if protocol[0] != "http" && protocol[0] != "https" {
 		return nil, errors.New("Invalid protocol. Expected http or https")
@@ -60,48 +176,36 @@ func (conf *SoapRequest) HttpCertAuth(data []byte) (*http.Response, error) {
 	header := conf.GetHttpHeader()
 	header["Authorization"] = "http://schemas.dmtf.org/wbem/wsman/1/wsman/secprofile/https/mutual"
 
-	if conf.HttpClient == nil {
-		conf.HttpClient = &http.Client{}
-	}
-
 	if protocol[0] != "https" {
 		return nil, errors.New("Invalid protocol for this transport type")
 	}
 
-	cert, err := tls.LoadX509KeyPair(conf.CertAuth.Cert, conf.CertAuth.Key)
+	client, err := conf.httpClient(true)
 	if err != nil {
 		return nil, err
 	}
-
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		Certificates: []tls.Certificate{
-			cert,
-		},
-	}
-
-	tr := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-	conf.HttpClient.Transport = tr
 	body := bytes.NewBuffer(data)
 	req, err := http.NewRequest("POST", conf.Endpoint, body)
 	req.ContentLength = int64(len(data))
 	for k, v := range header {
 		req.Header.Add(k, v)
 	}
-	resp, err := conf.HttpClient.Do(req)
+	resp, err := doRequest(ctx, client, req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(fmt.Sprintf("Remote host returned error status code: %d", resp.StatusCode))
+		return nil, statusError(resp)
 	}
 	//fmt.Printf("%v\n%v\n", resp, err)
 	return resp, err
 }
 
 func (conf *SoapRequest) HttpBasicAuth(data []byte) (*http.Response, error) {
+	return conf.httpBasicAuth(context.Background(), data)
+}
+
+func (conf *SoapRequest) httpBasicAuth(ctx context.Context, data []byte) (*http.Response, error) {
 	protocol := strings.Split(conf.Endpoint, ":")
 	if protocol[0] != "http" && protocol[0] != "https" {
 		return nil, errors.New("Invalid protocol. Expected http or https")
@@ -109,15 +213,9 @@ func (conf *SoapRequest) HttpBasicAuth(data []byte) (*http.Response, error) {
 
 	header := conf.GetHttpHeader()
 
-	if conf.HttpClient == nil {
-		conf.HttpClient = &http.Client{}
-	}
-	// Ignore SSL certificate errors
-	if protocol[0] == "https" {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: conf.HttpInsecure},
-		}
-		conf.HttpClient.Transport = tr
+	client, err := conf.httpClient(false)
+	if err != nil {
+		return nil, err
 	}
 	body := bytes.NewBuffer(data)
 	req, err := http.NewRequest("POST", conf.Endpoint, body)
@@ -128,12 +226,640 @@ func (conf *SoapRequest) HttpBasicAuth(data []byte) (*http.Response, error) {
 		req.Header.Add(k, v)
 	}
 
-	resp, err := conf.HttpClient.Do(req)
+	resp, err := doRequest(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp)
+	}
+	return resp, err
+}
+
+// defaultMaxIdleConns is how many idle connections are kept by default,
+// enough for a few commands running concurrently
+const defaultMaxIdleConns = 8
+
+// defaultIdleConnTimeout is how long an idle connection is kept by default
+const defaultIdleConnTimeout = 90 * time.Second
+
+// sharedState is what the requests of a SoapRequest share: connections,
+// Kerberos tickets and the scheme picked by AuthType Auto
+type sharedState struct {
+	client   *sharedClient
+	conns    *connPool
+	kerberos *kerberosLogin
+	auto     *autoAuth
+}
+
+var (
+	// setupMu guards the lazy setup of every SoapRequest
+	setupMu sync.Mutex
+	// sharedStates holds the state of the SoapRequests set up lazily, by
+	// their settings, so that the copies of a SoapRequest passed by value,
+	// as to the methods of Envelope, share it too. It is never pruned; a
+	// Client keeps its state to itself.
+	sharedStates = map[string]*sharedState{}
+)
+
+// setup sets, on first use, the state shared by the requests of conf and
+// of the copies of conf with the same settings
+func (conf *SoapRequest) setup() {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	if conf.client != nil {
+		return
+	}
+	key := conf.stateKey()
+	state, ok := sharedStates[key]
+	if !ok {
+		state = &sharedState{
+			client:   &sharedClient{},
+			conns:    &connPool{},
+			kerberos: &kerberosLogin{},
+			auto:     &autoAuth{},
+		}
+		sharedStates[key] = state
+	}
+	conf.client, conf.conns, conf.kerberos, conf.auto = state.client, state.conns, state.kerberos, state.auto
+}
+
+// stateKey identifies the exported settings of conf, those held by
+// reference by their address
+func (conf *SoapRequest) stateKey() string {
+	var key bytes.Buffer
+	v := reflect.ValueOf(conf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Interface && !field.IsNil() {
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.Ptr, reflect.Func, reflect.Map, reflect.Chan, reflect.Slice, reflect.UnsafePointer:
+			fmt.Fprintf(&key, "%x;", field.Pointer())
+		default:
+			fmt.Fprintf(&key, "%#v;", field.Interface())
+		}
+	}
+	return key.String()
+}
+
+// sharedClient holds the http.Clients sending the requests of BasicAuth
+// and CertAuth, by whether they present the certificate of CertAuth,
+// built once so that their connections and TLS sessions are reused
+type sharedClient struct {
+	mu      sync.Mutex
+	clients map[bool]HttpDoer
+}
+
+// httpClient returns the client sending the requests of BasicAuth and
+// CertAuth. An HttpClient other than an *http.Client without a Transport
+// is used as is, unless the TLS settings of conf apply, in which case they
+// are set on a clone of its *http.Transport. Otherwise a transport keeping
+// connections alive and resuming TLS sessions is built on the first call
+// for each value of certAuth, with the certificate of CertAuth when it is
+// set.
+func (conf *SoapRequest) httpClient(certAuth bool) (HttpDoer, error) {
+	base, isClient := conf.HttpClient.(*http.Client)
+	if conf.HttpClient != nil && (!isClient || base.Transport != nil) && !conf.needsTLSConfig(certAuth) {
+		return conf.HttpClient, nil
+	}
+	caller, err := conf.callerTransport()
+	if err != nil {
+		return nil, err
+	}
+	conf.setup()
+	conf.client.mu.Lock()
+	defer conf.client.mu.Unlock()
+	if client, ok := conf.client.clients[certAuth]; ok {
+		return client, nil
+	}
+
+	var tr *http.Transport
+	if caller != nil {
+		tr = caller.Clone()
+	} else {
+		maxIdle := conf.MaxIdleConns
+		if maxIdle == 0 {
+			maxIdle = defaultMaxIdleConns
+		}
+		idleTimeout := conf.IdleConnTimeout
+		if idleTimeout == 0 {
+			idleTimeout = defaultIdleConnTimeout
+		}
+		tr = &http.Transport{
+			MaxIdleConns:        maxIdle,
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     idleTimeout,
+		}
+	}
+	tlsConfig, err := conf.tlsConfig(tr.TLSClientConfig, certAuth)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	tr.TLSClientConfig = tlsConfig
+
+	// the other settings of HttpClient, such as its Timeout, are kept
+	client := &http.Client{}
+	if base != nil {
+		*client = *base
+	}
+	client.Transport = wrapTransport(tr, conf.WrapTransport)
+	if conf.client.clients == nil {
+		conf.client.clients = map[bool]HttpDoer{}
+	}
+	conf.client.clients[certAuth] = client
+	return client, nil
+}
+
+// needsTLSConfig reports whether the requests to the endpoint need the TLS
+// settings of conf: a client certificate, a CA, HttpInsecure,
+// Verification or KnownHosts
+func (conf *SoapRequest) needsTLSConfig(certAuth bool) bool {
+	if !strings.HasPrefix(conf.Endpoint, "https:") {
+		return false
+	}
+	return certAuth || conf.HttpInsecure || conf.Verification != nil || conf.KnownHosts != nil ||
+		conf.CertAuth != nil && conf.CertAuth.CA != ""
+}
+
+// callerTransport returns the transport of HttpClient, on a clone of which
+// the TLS settings of conf are applied. It is nil when HttpClient has none.
+func (conf *SoapRequest) callerTransport() (*http.Transport, error) {
+	if conf.HttpClient == nil {
+		return nil, nil
+	}
+	base, ok := conf.HttpClient.(*http.Client)
+	if !ok {
+		return nil, errors.New("HttpClient must be an *http.Client to apply CertAuth, HttpInsecure, Verification or KnownHosts")
+	}
+	if base.Transport == nil {
+		return nil, nil
+	}
+	tr, ok := base.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("The Transport of HttpClient must be an *http.Transport to apply CertAuth, HttpInsecure, Verification or KnownHosts")
+	}
+	return tr, nil
+}
+
+// wrapTransport returns tr wrapped by wrap, if set
+func wrapTransport(tr http.RoundTripper, wrap func(http.RoundTripper) http.RoundTripper) http.RoundTripper {
+	if wrap == nil {
+		return tr
+	}
+	return wrap(tr)
+}
+
+func (conf *SoapRequest) HttpNTLMAuth(data []byte) (*http.Response, error) {
+	return conf.httpNTLMAuth(context.Background(), data)
+}
+
+// httpNTLMAuth posts data over a connection authenticated with NTLMv2,
+// running the negotiate/challenge/authenticate handshake first if needed
+func (conf *SoapRequest) httpNTLMAuth(ctx context.Context, data []byte) (*http.Response, error) {
+	protocol := strings.Split(conf.Endpoint, ":")
+	if protocol[0] != "http" && protocol[0] != "https" {
+		return nil, errors.New("Invalid protocol. Expected http or https")
+	}
+	conf.setup()
+
+	conn, err := conf.conns.get(conf)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conf.ntlmRoundTrip(ctx, conn, data)
+	if err != nil {
+		return nil, err
+	}
+	// the connection goes back to the pool once the response is consumed
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { conf.conns.put(conn) }}
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp)
+	}
+	return resp, nil
+}
+
+// ntlmRoundTrip sends data on conn, authenticating the connection first
+// if it is new or the server dropped its authentication. Messages to http
+// endpoints are sealed with the session key of the connection.
+func (conf *SoapRequest) ntlmRoundTrip(ctx context.Context, conn *authConn, data []byte) (*http.Response, error) {
+	encrypt := conf.encrypted()
+	if conn.authenticated {
+		resp, err := conf.authSend(ctx, conn, data, spnegoEncryptedProtocol)
+		if err != nil || resp.StatusCode != 401 {
+			return resp, err
+		}
+		drainBody(resp)
+		conn.authenticated = false
+	}
+
+	resp, err := conf.authPost(ctx, conn, nil, "Negotiate", ntlmNegotiateMessage())
+	if err != nil {
+		return nil, err
+	}
+	drainBody(resp)
+	token := negotiateToken(resp, "Negotiate", "NTLM")
+	if resp.StatusCode != 401 || token == nil {
+		return nil, errors.New(fmt.Sprintf("NTLM handshake failed: remote host returned status code %d without a challenge", resp.StatusCode))
+	}
+	challenge, err := parseNTLMChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	msg, session, err := ntlmAuthenticateMessage(conf.Username, conf.Passwd, challenge, time.Now(), ntlmRandom)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypt {
+		resp, err = conf.authPost(ctx, conn, data, "Negotiate", msg)
+		if err == nil && resp.StatusCode != 401 {
+			conn.authenticated, conn.sealer = true, session
+		}
+		return resp, err
+	}
+
+	// sealed messages can only follow a completed handshake, which is
+	// therefore made with an empty body
+	if session.Flags&ntlmNegotiateSeal == 0 {
+		return nil, errors.New("NTLM server does not support message encryption")
+	}
+	resp, err = conf.authPost(ctx, conn, nil, "Negotiate", msg)
+	if err != nil || resp.StatusCode != 200 {
+		return resp, err
+	}
+	drainBody(resp)
+	conn.authenticated, conn.sealer = true, session
+	return conf.authSend(ctx, conn, data, spnegoEncryptedProtocol)
+}
+
+func (conf *SoapRequest) HttpKerberosAuth(data []byte) (*http.Response, error) {
+	return conf.httpKerberosAuth(context.Background(), data)
+}
+
+// httpKerberosAuth posts data over a connection authenticated with a
+// Kerberos service ticket, presented through the Negotiate scheme
+func (conf *SoapRequest) httpKerberosAuth(ctx context.Context, data []byte) (*http.Response, error) {
+	protocol := strings.Split(conf.Endpoint, ":")
+	if protocol[0] != "http" && protocol[0] != "https" {
+		return nil, errors.New("Invalid protocol. Expected http or https")
+	}
+	conf.setup()
+
+	conn, err := conf.conns.get(conf)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := conf.kerberosRoundTrip(ctx, conn, data)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { conf.conns.put(conn) }}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(fmt.Sprintf("Remote host returned error status code: %d", resp.StatusCode))
+		return nil, statusError(resp)
+	}
+	return resp, nil
+}
+
+// kerberosRoundTrip sends data on conn, presenting a service ticket along
+// with it if the connection is not authenticated yet. The server must
+// prove its identity in the response. Messages to http endpoints are
+// sealed with the key of the security context.
+func (conf *SoapRequest) kerberosRoundTrip(ctx context.Context, conn *authConn, data []byte) (*http.Response, error) {
+	encrypt := conf.encrypted()
+	if conn.authenticated {
+		resp, err := conf.authSend(ctx, conn, data, kerberosEncryptedProtocol)
+		if err != nil || resp.StatusCode != 401 {
+			return resp, err
+		}
+		drainBody(resp)
+		conn.authenticated = false
+	}
+
+	cl, err := conf.kerberos.get(conf)
+	if err != nil {
+		return nil, err
+	}
+	spn, err := kerberosSPN(conf.Endpoint, conf.kerberosCredentials())
+	if err != nil {
+		return nil, err
+	}
+	token, session, err := kerberosInitiate(cl, spn)
+	if err != nil {
+		return nil, err
+	}
+	// sealed messages can only follow an established context, which is
+	// therefore set up with an empty body
+	body := data
+	if encrypt {
+		body = nil
+	}
+	resp, err := conf.authPost(ctx, conn, body, "Negotiate", token)
+	if err != nil || resp.StatusCode == 401 {
+		return resp, err
+	}
+	if err := session.accept(negotiateToken(resp, "Negotiate", "Kerberos")); err != nil {
+		drainBody(resp)
+		return nil, err
+	}
+	conn.authenticated, conn.sealer = true, session
+	if !encrypt || resp.StatusCode != 200 {
+		return resp, nil
+	}
+	drainBody(resp)
+	return conf.authSend(ctx, conn, data, kerberosEncryptedProtocol)
+}
+
+func (conf *SoapRequest) HttpCredSSPAuth(data []byte) (*http.Response, error) {
+	return conf.httpCredSSPAuth(context.Background(), data)
+}
+
+// httpCredSSPAuth posts data over a connection authenticated with
+// CredSSP, which delegates Username and Passwd to the server so that
+// commands can reach other hosts
+func (conf *SoapRequest) httpCredSSPAuth(ctx context.Context, data []byte) (*http.Response, error) {
+	protocol := strings.Split(conf.Endpoint, ":")
+	if protocol[0] != "http" && protocol[0] != "https" {
+		return nil, errors.New("Invalid protocol. Expected http or https")
+	}
+	conf.setup()
+
+	conn, err := conf.conns.get(conf)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conf.credsspRoundTrip(ctx, conn, data)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { conf.conns.put(conn) }}
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp)
+	}
+	return resp, nil
+}
+
+// credsspRoundTrip sends data on conn, running the CredSSP handshake
+// first if the connection is not authenticated yet. Messages to http
+// endpoints are sealed with the TLS channel of the handshake.
+func (conf *SoapRequest) credsspRoundTrip(ctx context.Context, conn *authConn, data []byte) (*http.Response, error) {
+	encrypt := conf.encrypted()
+	if conn.authenticated {
+		resp, err := conf.authSend(ctx, conn, data, credsspEncryptedProtocol)
+		if err != nil || resp.StatusCode != 401 {
+			return resp, err
+		}
+		drainBody(resp)
+		conn.authenticated = false
+	}
+
+	session := newCredSSPSession()
+	token, err := session.authenticate(conf.Username, conf.Passwd, func(token []byte) ([]byte, error) {
+		resp, err := conf.authPost(ctx, conn, nil, "CredSSP", token)
+		if err != nil {
+			return nil, err
+		}
+		drainBody(resp)
+		reply := negotiateToken(resp, "CredSSP")
+		if resp.StatusCode != 401 || reply == nil {
+			return nil, errors.New(fmt.Sprintf("CredSSP handshake failed: remote host returned status code %d without a token", resp.StatusCode))
+		}
+		return reply, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// sealed messages can only follow the delegation of the credentials,
+	// which is therefore sent with an empty body
+	body := data
+	if encrypt {
+		body = nil
+	}
+	resp, err := conf.authPost(ctx, conn, body, "CredSSP", token)
+	if err != nil || resp.StatusCode == 401 {
+		return resp, err
+	}
+	conn.authenticated, conn.sealer = true, session
+	if !encrypt || resp.StatusCode != 200 {
+		return resp, nil
+	}
+	drainBody(resp)
+	return conf.authSend(ctx, conn, data, credsspEncryptedProtocol)
+}
+
+// kerberosCredentials returns conf.Kerberos, defaulting to the system
+// krb5.conf and Passwd
+func (conf *SoapRequest) kerberosCredentials() *KerberosCredentials {
+	if conf.Kerberos == nil {
+		return &KerberosCredentials{}
+	}
+	return conf.Kerberos
+}
+
+// authSend posts data on the authenticated conn. Messages to http
+// endpoints are sealed for protocol with the session key of conn.
+func (conf *SoapRequest) authSend(ctx context.Context, conn *authConn, data []byte, protocol string) (*http.Response, error) {
+	if !conf.encrypted() {
+		return conf.authPost(ctx, conn, data, "", nil)
+	}
+	return conf.postEncrypted(ctx, conn.client, conn.sealer, protocol, data)
+}
+
+// encrypted reports whether messages must be sealed by the authentication
+// scheme, which is the case over plain http
+func (conf *SoapRequest) encrypted() bool {
+	return strings.HasPrefix(conf.Endpoint, "http:")
+}
+
+// postEncrypted seals data into a multipart/encrypted body, posts it with
+// client and replaces the body of an encrypted response with the SOAP
+// message it carries
+func (conf *SoapRequest) postEncrypted(ctx context.Context, client HttpDoer, sealer sessionSealer, protocol string, data []byte) (*http.Response, error) {
+	body, err := encryptMessage(sealer, protocol, data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", conf.Endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range conf.GetHttpHeader() {
+		req.Header.Add(k, v)
+	}
+	req.Header.Set("Content-Type", encryptedContentType(protocol, len(data)))
+
+	resp, err := doRequest(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "multipart/encrypted") && !strings.HasPrefix(contentType, "multipart/x-multi-encrypted") {
+		return resp, nil
+	}
+	encrypted, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := decryptMessage(sealer, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(msg))
+	resp.ContentLength = int64(len(msg))
+	resp.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	return resp, nil
+}
+
+// authPost posts data on conn, carrying token under scheme in the
+// Authorization header when it is not nil
+func (conf *SoapRequest) authPost(ctx context.Context, conn *authConn, data []byte, scheme string, token []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", conf.Endpoint, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(data))
+	for k, v := range conf.GetHttpHeader() {
+		req.Header.Add(k, v)
+	}
+	if token != nil {
+		req.Header.Set("Authorization", scheme+" "+base64.StdEncoding.EncodeToString(token))
+	}
+	return doRequest(ctx, conn.client, req)
+}
+
+// negotiateToken extracts the token carried by the WWW-Authenticate
+// headers of resp under one of schemes
+func negotiateToken(resp *http.Response, schemes ...string) []byte {
+	for _, header := range resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		fields := strings.Fields(header)
+		if len(fields) != 2 || !hasScheme(schemes, fields[0]) {
+			continue
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[1])
+		if err == nil {
+			return token
+		}
+	}
+	return nil
+}
+
+func hasScheme(schemes []string, scheme string) bool {
+	for _, s := range schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// drainBody consumes and closes the body of resp so that its connection
+// can carry the next request
+func drainBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// authConn is a connection authenticated by a connection based scheme
+// such as NTLM. Each authConn has its own transport and carries a single
+// request at a time.
+type authConn struct {
+	client        *http.Client
+	authenticated bool
+	// sealer encrypts the messages of the connection, if the scheme
+	// negotiated a session key
+	sealer sessionSealer
+}
+
+// connPool keeps idle authenticated connections for reuse by later
+// requests
+type connPool struct {
+	mu   sync.Mutex
+	idle []*authConn
+	// sessions lets new connections resume the TLS sessions of earlier
+	// ones
+	sessions tls.ClientSessionCache
+}
+
+// get returns an idle connection, or a new unauthenticated one to the
+// endpoint of conf
+func (pool *connPool) get(conf *SoapRequest) (*authConn, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if n := len(pool.idle); n > 0 {
+		conn := pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+		return conn, nil
+	}
+	// the proxy, dialer and TLS settings of an *http.Transport of
+	// HttpClient are kept
+	tr := &http.Transport{}
+	if caller, err := conf.callerTransport(); err == nil && caller != nil {
+		tr = caller.Clone()
+	}
+	tlsConfig, err := conf.tlsConfig(tr.TLSClientConfig, false)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		if pool.sessions == nil {
+			pool.sessions = tls.NewLRUClientSessionCache(0)
+		}
+		tlsConfig.ClientSessionCache = pool.sessions
+	}
+	tr.TLSClientConfig = tlsConfig
+	return &authConn{client: &http.Client{Transport: wrapTransport(tr, conf.WrapTransport)}}, nil
+}
+
+// put returns conn to the pool once its response has been consumed
+func (pool *connPool) put(conn *authConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.idle = append(pool.idle, conn)
+}
+
+// releaseBody calls release once the wrapped body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (body *releaseBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
+
+// statusError consumes a non 200 response and returns the matching error,
+// a *WSManFault if the response carries a SOAP fault
+func statusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		if fault := parseFault(body); fault != nil {
+			return fault
+		}
+	}
+	return errors.New(fmt.Sprintf("Remote host returned error status code: %d", resp.StatusCode))
+}
+
+// doRequest sends req using client, aborting it once ctx is done, in
+// which case ctx.Err() is returned
+func doRequest(ctx context.Context, client HttpDoer, req *http.Request) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 	return resp, err
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"strings"
 )
 
 func Uuid() (string, error) {
@@ -15,3 +16,46 @@ func Uuid() (string, error) {
 	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 	return uuid, nil
 }
+
+// EscapeArg quotes arg so that CommandLineToArgvW, which most Windows
+// programs use to split their command line, reads it back unchanged
+func EscapeArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(arg, " \t\n\v\"") {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(arg); i++ {
+		switch arg[i] {
+		case '\\':
+			slashes++
+		case '"':
+			// the backslashes before a quote and the quote itself
+			// are escaped
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteByte(arg[i])
+	}
+	// backslashes before the closing quote would escape it
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// JoinArgs serializes args into a command line that CommandLineToArgvW
+// splits back into args. It is meant for the Args of a command started
+// with SkipCmdShell, as cmd.exe applies rules of its own.
+func JoinArgs(args []string) string {
+	escaped := make([]string, len(args))
+	for i, arg := range args {
+		escaped[i] = EscapeArg(arg)
+	}
+	return strings.Join(escaped, " ")
+}
@@ -2,6 +2,7 @@ package winrm
 
 import (
 	"regexp"
+	"strings"
 
 	gc "launchpad.net/gocheck"
 
@@ -23,3 +24,95 @@ func (utilSuite) TestUUID(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(uuid, jc.Satisfies, IsValidUUID)
 }
+
+// escapeArgTests are arguments that cmd.exe or a naive quoting would mangle
+var escapeArgTests = []struct {
+	arg     string
+	escaped string
+}{
+	{``, `""`},
+	{`plain`, `plain`},
+	{`C:\Program Files\app.exe`, `"C:\Program Files\app.exe"`},
+	{`a b`, `"a b"`},
+	{"tab\there", "\"tab\there\""},
+	{`say "hi"`, `"say \"hi\""`},
+	{`"`, `"\""`},
+	{`a"b`, `"a\"b"`},
+	{`C:\dir\`, `C:\dir\`},
+	{`C:\my dir\`, `"C:\my dir\\"`},
+	{`\\server\share\`, `\\server\share\`},
+	{`\"`, `"\\\""`},
+	{`\\"quoted\\"`, `"\\\\\"quoted\\\\\""`},
+	{`50%`, `50%`},
+	{`%PATH%`, `%PATH%`},
+	{`a^b`, `a^b`},
+	{`a&b|c<d>e`, `a&b|c<d>e`},
+	{`'single'`, `'single'`},
+	{`ünïcödé ✓`, `"ünïcödé ✓"`},
+}
+
+func (utilSuite) TestEscapeArg(c *gc.C) {
+	for _, t := range escapeArgTests {
+		c.Assert(EscapeArg(t.arg), gc.Equals, t.escaped, gc.Commentf("%q", t.arg))
+	}
+}
+
+// splitCommandLine splits a command line by the rules CommandLineToArgvW
+// applies to the arguments following the program name
+func splitCommandLine(line string) []string {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case ch == '\\':
+			slashes := 0
+			for ; i < len(line) && line[i] == '\\'; i++ {
+				slashes++
+			}
+			if i < len(line) && line[i] == '"' {
+				arg.WriteString(strings.Repeat(`\`, slashes/2))
+				if slashes%2 == 1 {
+					arg.WriteByte('"')
+				} else {
+					quoted = !quoted
+				}
+			} else {
+				arg.WriteString(strings.Repeat(`\`, slashes))
+				i--
+			}
+			inArg = true
+		case ch == '"':
+			if quoted && i+1 < len(line) && line[i+1] == '"' {
+				arg.WriteByte('"')
+				i++
+			} else {
+				quoted = !quoted
+			}
+			inArg = true
+		case (ch == ' ' || ch == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+func (utilSuite) TestJoinArgsRoundTrip(c *gc.C) {
+	var args []string
+	for _, t := range escapeArgTests {
+		args = append(args, t.arg)
+		c.Assert(splitCommandLine(EscapeArg(t.arg)), gc.DeepEquals, []string{t.arg}, gc.Commentf("%q", t.arg))
+	}
+	c.Assert(splitCommandLine(JoinArgs(args)), gc.DeepEquals, args)
+	c.Assert(JoinArgs([]string{"/c", "echo", "a b"}), gc.Equals, `/c echo "a b"`)
+}
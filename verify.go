@@ -0,0 +1,156 @@
+package winrm
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ServerVerification sets how the certificate of an https endpoint is
+// verified. The zero value verifies it against the system pool.
+type ServerVerification struct {
+	// CA is the path of a PEM bundle of the authorities trusted to sign
+	// the certificate of the server, in place of the system pool
+	CA string
+	// ServerName is the name expected in the certificate of the server,
+	// and sent to it, in place of the host of the endpoint. It lets a host
+	// reached by IP address be verified.
+	ServerName string
+	// MinVersion is the lowest TLS version accepted, such as
+	// tls.VersionTLS12; the default of crypto/tls if zero
+	MinVersion uint16
+	// CipherSuites restricts the cipher suites offered for TLS 1.2 and
+	// lower; the defaults of crypto/tls if empty
+	CipherSuites []uint16
+	// PinnedKeys are the PublicKeyPin of the keys trusted for the server.
+	// When set, the certificate of the server or one of its verified
+	// authorities must hold one of them. With HttpInsecure, the chain is
+	// not verified and the certificate of the server must hold one.
+	PinnedKeys []string
+}
+
+// PublicKeyPin returns the base64 SHA-256 hash of the SubjectPublicKeyInfo
+// of cert, as expected by ServerVerification.PinnedKeys. It matches
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsConfig returns the TLS settings of the connections to the endpoint,
+// verifying the server as set by Verification, the CA of CertAuth and
+// KnownHosts. The certificate of CertAuth is loaded when certAuth is set.
+// The settings are applied to a clone of base, when set, whose other
+// fields are kept.
+func (conf *SoapRequest) tlsConfig(base *tls.Config, certAuth bool) (*tls.Config, error) {
+	verify := conf.Verification
+	if verify == nil {
+		verify = &ServerVerification{}
+	}
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if conf.HttpInsecure {
+		config.InsecureSkipVerify = true
+	}
+	if verify.ServerName != "" {
+		config.ServerName = verify.ServerName
+	}
+	if verify.MinVersion != 0 {
+		config.MinVersion = verify.MinVersion
+	}
+	if verify.CipherSuites != nil {
+		config.CipherSuites = verify.CipherSuites
+	}
+
+	ca := verify.CA
+	if ca == "" && conf.CertAuth != nil {
+		ca = conf.CertAuth.CA
+	}
+	if ca != "" {
+		bundle, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errors.New(fmt.Sprintf("No certificate found in CA bundle %s", ca))
+		}
+	}
+	var checks []func(tls.ConnectionState) error
+	if config.VerifyConnection != nil {
+		checks = append(checks, config.VerifyConnection)
+	}
+	if len(verify.PinnedKeys) > 0 {
+		pins := make(map[string]bool, len(verify.PinnedKeys))
+		for _, pin := range verify.PinnedKeys {
+			pins[pin] = true
+		}
+		checks = append(checks, func(state tls.ConnectionState) error {
+			return checkPins(state, pins)
+		})
+	}
+	if conf.KnownHosts != nil && strings.HasPrefix(conf.Endpoint, "https:") {
+		host, err := EndpointHost(conf.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		// the recorded certificate is trusted in place of a chain, unless
+		// a CA is configured to verify it as well
+		if config.RootCAs == nil {
+			config.InsecureSkipVerify = true
+		}
+		checks = append(checks, func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("Server presented no certificate")
+			}
+			return conf.KnownHosts.Check(host, state.PeerCertificates[0])
+		})
+	}
+	if len(checks) > 0 {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, check := range checks {
+				if err := check(state); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if certAuth {
+		cert, err := conf.CertAuth.certificate()
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		// HTTP.sys asks for the certificate by renegotiating
+		config.Renegotiation = tls.RenegotiateOnceAsClient
+	}
+	return config, nil
+}
+
+// checkPins verifies that the server of state holds one of pins. Only the
+// certificate of the server proved its key when the chain is not verified.
+func checkPins(state tls.ConnectionState, pins map[string]bool) error {
+	var certs []*x509.Certificate
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(state.VerifiedChains) == 0 && len(state.PeerCertificates) > 0 {
+		certs = state.PeerCertificates[:1]
+	}
+	for _, cert := range certs {
+		if pins[PublicKeyPin(cert)] {
+			return nil
+		}
+	}
+	return errors.New("Server certificate does not match any pinned key")
+}
@@ -0,0 +1,155 @@
+package winrm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+
+	gc "launchpad.net/gocheck"
+)
+
+type VerifySuite struct{}
+
+var _ = gc.Suite(VerifySuite{})
+
+// writeCA writes the certificate of server to a PEM bundle and returns its
+// path
+func writeCA(c *gc.C, server *fakeWinRM) string {
+	path := filepath.Join(c.MkDir(), "ca.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(path, bundle, 0644), gc.IsNil)
+	return path
+}
+
+func verifiedClient(c *gc.C, server *fakeWinRM, verify *ServerVerification, options ...ClientOption) *Client {
+	options = append(options, WithBasicAuth("leeroy", "jenkins"), WithServerVerification(verify))
+	client, err := NewClient(server.URL, options...)
+	c.Assert(err, gc.IsNil)
+	return client
+}
+
+func (VerifySuite) TestVerifySystemPool(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	err := executeCommand(verifiedClient(c, server, nil))
+	c.Assert(err, gc.ErrorMatches, ".*certificate signed by unknown authority")
+	c.Assert(server.seen(), gc.HasLen, 0)
+}
+
+func (VerifySuite) TestVerifyCA(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	err := executeCommand(verifiedClient(c, server, &ServerVerification{CA: writeCA(c, server)}))
+	c.Assert(err, gc.IsNil)
+}
+
+func (VerifySuite) TestVerifyBadCA(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	path := filepath.Join(c.MkDir(), "ca.pem")
+	c.Assert(ioutil.WriteFile(path, []byte("not a certificate"), 0644), gc.IsNil)
+	err := executeCommand(verifiedClient(c, server, &ServerVerification{CA: path}))
+	c.Assert(err, gc.ErrorMatches, "No certificate found in CA bundle .*ca.pem")
+}
+
+func (VerifySuite) TestVerifyServerName(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+	ca := writeCA(c, server)
+
+	// the endpoint is reached by IP address, the certificate also names
+	// example.com
+	err := executeCommand(verifiedClient(c, server, &ServerVerification{CA: ca, ServerName: "example.com"}))
+	c.Assert(err, gc.IsNil)
+	err = executeCommand(verifiedClient(c, server, &ServerVerification{CA: ca, ServerName: "winhost.contoso.com"}))
+	c.Assert(err, gc.ErrorMatches, ".*certificate is valid for .*, not winhost.contoso.com")
+}
+
+func (VerifySuite) TestVerifyMinVersion(c *gc.C) {
+	server := newUnstartedFakeWinRM()
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	ca := writeCA(c, server)
+
+	err := executeCommand(verifiedClient(c, server, &ServerVerification{CA: ca, MinVersion: tls.VersionTLS12}))
+	c.Assert(err, gc.IsNil)
+	err = executeCommand(verifiedClient(c, server, &ServerVerification{CA: ca, MinVersion: tls.VersionTLS13}))
+	c.Assert(err, gc.ErrorMatches, ".*protocol version.*")
+}
+
+func (VerifySuite) TestVerifyCipherSuites(c *gc.C) {
+	server := newUnstartedFakeWinRM()
+	server.TLS = &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	server.StartTLS()
+	defer server.Close()
+	ca := writeCA(c, server)
+
+	err := executeCommand(verifiedClient(c, server, &ServerVerification{
+		CA:           ca,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}))
+	c.Assert(err, gc.IsNil)
+	err = executeCommand(verifiedClient(c, server, &ServerVerification{
+		CA:           ca,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+	}))
+	c.Assert(err, gc.ErrorMatches, ".*handshake failure")
+}
+
+func (VerifySuite) TestVerifyPinnedKeys(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+	pin := PublicKeyPin(server.Certificate())
+
+	err := executeCommand(verifiedClient(c, server, &ServerVerification{CA: writeCA(c, server), PinnedKeys: []string{pin}}))
+	c.Assert(err, gc.IsNil)
+	// a pinned key alone is enough to trust a self-signed certificate
+	err = executeCommand(verifiedClient(c, server, &ServerVerification{PinnedKeys: []string{"bm9wZQ==", pin}}, WithInsecure()))
+	c.Assert(err, gc.IsNil)
+	err = executeCommand(verifiedClient(c, server, &ServerVerification{PinnedKeys: []string{"bm9wZQ=="}}, WithInsecure()))
+	c.Assert(err, gc.ErrorMatches, ".*Server certificate does not match any pinned key")
+}
+
+func (VerifySuite) TestVerifyCertAuthCA(c *gc.C) {
+	server := newFakeWinRMTLS()
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		CertAuth: &CertificateCredentials{CA: writeCA(c, server)},
+	}
+	config, err := req.tlsConfig(nil, false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.InsecureSkipVerify, gc.Equals, false)
+	_, err = server.Certificate().Verify(x509.VerifyOptions{Roots: config.RootCAs})
+	c.Assert(err, gc.IsNil)
+}
+
+func (VerifySuite) TestVerifyNTLM(c *gc.C) {
+	server := newNTLMServer(c, "Passw0rd", true)
+	defer server.Close()
+
+	req := SoapRequest{
+		Endpoint: server.URL,
+		AuthType: "NTLMAuth",
+		Username: `WINHOST\Administrator`,
+		Passwd:   "Passw0rd",
+	}
+	_, err := req.HttpNTLMAuth([]byte("trololol"))
+	c.Assert(err, gc.ErrorMatches, ".*certificate signed by unknown authority")
+
+	req.Verification = &ServerVerification{PinnedKeys: []string{PublicKeyPin(server.Certificate())}}
+	req.HttpInsecure = true
+	resp, err := req.HttpNTLMAuth([]byte("trololol"))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+}
@@ -62,7 +62,7 @@ type Command struct {
 
 type DesiredStreamProps struct {
 	Value string `xml:",innerxml"`
-	Attr  string `xml:"CommandId,attr"`
+	Attr  string `xml:"CommandId,attr,omitempty"`
 }
 
 type Receive struct {
@@ -74,6 +74,17 @@ type Signal struct {
 	Code string `xml:"rsp:Code"`
 }
 
+type SendStream struct {
+	Value     string `xml:",innerxml"`
+	Name      string `xml:"Name,attr"`
+	CommandId string `xml:"CommandId,attr"`
+	End       string `xml:"End,attr,omitempty"`
+}
+
+type Send struct {
+	Stream SendStream `xml:"rsp:Stream"`
+}
+
 type EnvVariable struct {
 	Value string `xml:",innerxml"`
 	Name  string `xml:"Name,attr"`
@@ -95,6 +106,7 @@ type BodyStruct struct {
 	CommandLine *Command `xml:"rsp:CommandLine,omitempty"`
 	Receive     *Receive `xml:"rsp:Receive,omitempty"`
 	Signal      *Signal  `xml:"rsp:Signal,omitempty"`
+	Send        *Send    `xml:"rsp:Send,omitempty"`
 	Shell       *Shell   `xml:"rsp:Shell"`
 }
 